@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DefaultsSource looks up the default values the distribution provides for properties
+type DefaultsSource interface {
+	// Defaults returns the default value of each queried property that has one. Properties
+	// without a default are left out of the result.
+	Defaults(queries map[string][]string) (map[string]map[string]Value, error)
+}
+
+// Backend is a store of xfconf properties that profiles are applied to
+type Backend interface {
+	DefaultsSource
+
+	// Get returns the value of a property and whether it is set
+	Get(channel, property string) (Value, bool, error)
+	// List returns every property set in a channel
+	List(channel string) (map[string]Value, error)
+	// Set creates or changes a property
+	Set(channel, property string, value Value) error
+	// Reset a property to its default value. With recursive, every property below it is reset too.
+	Reset(channel, property string, recursive bool) error
+	// Close releases any resources held by the backend
+	Close() error
+}
+
+// Backends that can be chosen on the command line
+const (
+	BackendAuto        = "auto"
+	BackendDBus        = "dbus"
+	BackendXfconfQuery = "xfconf-query"
+	BackendXML         = "xml"
+)
+
+// Target selects whose settings are changed. The zero value is the calling user's session.
+type Target struct {
+	// Home directory of another user, or the skeleton home directory of an image
+	Home string
+	// Root of a system image. Defaults are read from the image, and Home is inside of it.
+	Root string
+}
+
+func (t Target) isSession() bool {
+	return t.Home == "" && t.Root == ""
+}
+
+// The perchannel XML directory of the target's home
+func (t Target) perchannelDir() string {
+	if t.isSession() {
+		return perchannelDir(xdgConfigHome())
+	}
+
+	home := t.Home
+	if home == "" {
+		// New users of an image start from a copy of /etc/skel
+		home = "/etc/skel"
+	}
+	return perchannelDir(filepath.Join(t.Root, home, ".config"))
+}
+
+// The user that files written in the target's home should belong to, if it is another user's home.
+// Homes in an image are left as they are, since their users only exist in the image.
+func (t Target) owner() (*fileOwner, error) {
+	if t.Home == "" || t.Root != "" {
+		return nil, nil
+	}
+
+	owner, err := ownerOf(t.Home)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the owner of %s: %v", t.Home, err)
+	}
+	if owner.uid == os.Geteuid() {
+		return nil, nil
+	}
+	return owner, nil
+}
+
+// Open the backend for the target's settings. For the user's session, xfconfd is used over D-Bus
+// if it can be reached, and the perchannel XML files are changed directly otherwise. Other homes
+// and images are always changed through their XML files.
+func openBackend(cfg *Config, kind string, target Target) (Backend, error) {
+	defaults := systemDefaults(cfg.Defaults)
+
+	if !target.isSession() {
+		if kind != BackendAuto && kind != BackendXML {
+			return nil, fmt.Errorf("only the %s backend can change another home or root", BackendXML)
+		}
+		if target.Root != "" {
+			defaults = rootDefaults(target.Root)
+		}
+		backend := NewXfconfXML(target.perchannelDir(), defaults)
+		owner, err := target.owner()
+		if err != nil {
+			return nil, err
+		}
+		backend.owner = owner
+		return backend, nil
+	}
+
+	switch kind {
+	case BackendAuto:
+		bus, err := ConnectXfconfDBus()
+		if err != nil {
+			logger.Debug("Falling back to XML files", "reason", err)
+			return NewXfconfXML(perchannelDir(xdgConfigHome()), defaults), nil
+		}
+		bus.DefaultsSource = defaults
+		return bus, nil
+	case BackendDBus:
+		bus, err := ConnectXfconfDBus()
+		if err != nil {
+			return nil, err
+		}
+		bus.DefaultsSource = defaults
+		return bus, nil
+	case BackendXfconfQuery:
+		return &XfconfQuery{DefaultsSource: defaults}, nil
+	case BackendXML:
+		return NewXfconfXML(perchannelDir(xdgConfigHome()), defaults), nil
+	default:
+		return nil, fmt.Errorf("invalid backend: must be '%s', '%s', '%s' or '%s'", BackendAuto, BackendDBus, BackendXfconfQuery, BackendXML)
+	}
+}
+
+// MemoryBackend keeps properties in memory, which allows exercising profile logic without an Xfce
+// installation. Like xfconfd, defaults show through for properties that are not set.
+type MemoryBackend struct {
+	Properties    map[string]map[string]Value
+	DefaultValues map[string]map[string]Value
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		Properties:    make(map[string]map[string]Value),
+		DefaultValues: make(map[string]map[string]Value),
+	}
+}
+
+func (m *MemoryBackend) Get(channel, property string) (Value, bool, error) {
+	if value, ok := m.Properties[channel][property]; ok {
+		return value, true, nil
+	}
+	value, ok := m.DefaultValues[channel][property]
+	return value, ok, nil
+}
+
+func (m *MemoryBackend) List(channel string) (map[string]Value, error) {
+	values := make(map[string]Value)
+	for property, value := range m.DefaultValues[channel] {
+		values[property] = value
+	}
+	for property, value := range m.Properties[channel] {
+		values[property] = value
+	}
+	return values, nil
+}
+
+func (m *MemoryBackend) Set(channel, property string, value Value) error {
+	if m.Properties[channel] == nil {
+		m.Properties[channel] = make(map[string]Value)
+	}
+	m.Properties[channel][property] = value
+	return nil
+}
+
+func (m *MemoryBackend) Reset(channel, property string, recursive bool) error {
+	for name := range m.Properties[channel] {
+		if name == property || (recursive && isBelow(name, property)) {
+			delete(m.Properties[channel], name)
+		}
+	}
+	return nil
+}
+
+func (m *MemoryBackend) Defaults(queries map[string][]string) (map[string]map[string]Value, error) {
+	return lookupValues(m.DefaultValues, queries), nil
+}
+
+func (m *MemoryBackend) Close() error {
+	return nil
+}
+
+// previewBackend keeps the changes of a dry run in memory on top of another backend, so that each
+// step of the dry run sees the state the steps before it would have left. Reset properties read
+// as unset.
+type previewBackend struct {
+	Backend
+
+	// Properties changed by the dry run, with nil for the ones reset
+	changed map[string]map[string]*Value
+}
+
+// Wrap a backend for a dry run. A backend that is already wrapped is returned as is, so that the
+// steps of a dry run share their changes.
+func newPreviewBackend(backend Backend) Backend {
+	if _, ok := backend.(*previewBackend); ok {
+		return backend
+	}
+	return &previewBackend{Backend: backend, changed: make(map[string]map[string]*Value)}
+}
+
+func (p *previewBackend) record(channel, property string, value *Value) {
+	if p.changed[channel] == nil {
+		p.changed[channel] = make(map[string]*Value)
+	}
+	p.changed[channel][property] = value
+}
+
+func (p *previewBackend) Get(channel, property string) (Value, bool, error) {
+	if value, ok := p.changed[channel][property]; ok {
+		if value == nil {
+			return Value{}, false, nil
+		}
+		return *value, true, nil
+	}
+	return p.Backend.Get(channel, property)
+}
+
+func (p *previewBackend) List(channel string) (map[string]Value, error) {
+	values, err := p.Backend.List(channel)
+	if err != nil {
+		return nil, err
+	}
+	for property, value := range p.changed[channel] {
+		if value == nil {
+			delete(values, property)
+		} else {
+			values[property] = *value
+		}
+	}
+	return values, nil
+}
+
+func (p *previewBackend) Set(channel, property string, value Value) error {
+	p.record(channel, property, &value)
+	return nil
+}
+
+func (p *previewBackend) Reset(channel, property string, recursive bool) error {
+	if recursive {
+		values, err := p.List(channel)
+		if err != nil {
+			return err
+		}
+		for name := range values {
+			if isBelow(name, property) {
+				p.record(channel, name, nil)
+			}
+		}
+	}
+	p.record(channel, property, nil)
+	return nil
+}
+
+// The wrapped backend is closed by whoever opened it
+func (p *previewBackend) Close() error {
+	return nil
+}
+
+// Pick the queried properties out of a set of values
+func lookupValues(values map[string]map[string]Value, queries map[string][]string) map[string]map[string]Value {
+	results := make(map[string]map[string]Value)
+	for channel, properties := range queries {
+		results[channel] = make(map[string]Value)
+		for _, property := range properties {
+			if value, ok := values[channel][property]; ok {
+				results[channel][property] = value
+			}
+		}
+	}
+	return results
+}
+
+// Check whether a property is inside the subtree of another one
+func isBelow(property, parent string) bool {
+	return parent == "/" || strings.HasPrefix(property, parent+"/")
+}
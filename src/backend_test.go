@@ -0,0 +1,153 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A vendor's xfwm4 channel with the given default theme
+func vendorTheme(theme string) string {
+	return `<?xml version="1.0" encoding="UTF-8"?>
+
+<channel name="xfwm4" version="1.0">
+  <property name="general" type="empty">
+    <property name="theme" type="string" value="` + theme + `"/>
+  </property>
+</channel>
+`
+}
+
+func TestApplyIntoTarget(t *testing.T) {
+	tests := []struct {
+		name   string
+		target func(tmp string) Target
+		// Where the settings are written, relative to the temporary directory
+		wantDir string
+		// The default theme, which is read from the image with --root
+		wantDefault string
+	}{
+		{
+			name:        "session",
+			target:      func(tmp string) Target { return Target{} },
+			wantDir:     "config",
+			wantDefault: "System",
+		},
+		{
+			name:        "home",
+			target:      func(tmp string) Target { return Target{Home: filepath.Join(tmp, "home", "alice")} },
+			wantDir:     "home/alice/.config",
+			wantDefault: "System",
+		},
+		{
+			name:        "image",
+			target:      func(tmp string) Target { return Target{Root: filepath.Join(tmp, "image")} },
+			wantDir:     "image/etc/skel/.config",
+			wantDefault: "Image",
+		},
+		{
+			name:        "home in an image",
+			target:      func(tmp string) Target { return Target{Root: filepath.Join(tmp, "image"), Home: "/home/alice"} },
+			wantDir:     "image/home/alice/.config",
+			wantDefault: "Image",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tmp := t.TempDir()
+			t.Setenv("XDG_CONFIG_HOME", filepath.Join(tmp, "config"))
+			t.Setenv("XDG_CONFIG_DIRS", filepath.Join(tmp, "xdg"))
+			writeTestFile(t, filepath.Join(perchannelDir(filepath.Join(tmp, "xdg")), "xfwm4.xml"), vendorTheme("System"))
+			writeTestFile(t, filepath.Join(perchannelDir(filepath.Join(tmp, "image", tmp, "xdg")), "xfwm4.xml"), vendorTheme("Image"))
+			os.MkdirAll(filepath.Join(tmp, "home", "alice"), 0755)
+
+			backend, err := openBackend(&Config{Defaults: DefaultsXML}, BackendXML, test.target(tmp))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer backend.Close()
+
+			defaults, err := backend.Defaults(map[string][]string{"xfwm4": {"/general/theme"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := defaults["xfwm4"]["/general/theme"]; !got.Equal(str(test.wantDefault)) {
+				t.Errorf("default theme is %v, want %s", got, test.wantDefault)
+			}
+
+			profile := parseTestProfile(t, `{"properties": {"xfwm4": {"/general/theme": "Chicago95"}}}`)
+			if _, err := applyProperties(backend, profile, MergeHard, nil, false); err != nil {
+				t.Fatal(err)
+			}
+
+			dir := perchannelDir(filepath.Join(tmp, test.wantDir))
+			assertChannel(t, dir, "xfwm4", testValues{"xfwm4/general/theme": str("Chicago95")})
+
+			// None of the other targets was written to
+			for _, otherTest := range tests {
+				other := perchannelDir(filepath.Join(tmp, otherTest.wantDir))
+				if _, err := os.Stat(filepath.Join(other, "xfwm4.xml")); other != dir && !os.IsNotExist(err) {
+					t.Errorf("also wrote to %s", other)
+				}
+			}
+		})
+	}
+}
+
+func TestTargetBackends(t *testing.T) {
+	for _, kind := range []string{BackendDBus, BackendXfconfQuery} {
+		if _, err := openBackend(&Config{Defaults: DefaultsXML}, kind, Target{Home: t.TempDir()}); err == nil {
+			t.Errorf("the %s backend was opened for another home", kind)
+		}
+	}
+}
+
+func TestTargetOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("giving away files needs root")
+	}
+
+	home := t.TempDir()
+	if err := os.Chown(home, 1234, 1234); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		target Target
+		want   *fileOwner
+	}{
+		{name: "another user's home", target: Target{Home: home}, want: &fileOwner{uid: 1234, gid: 1234}},
+		{name: "own home", target: Target{Home: t.TempDir()}},
+		{name: "image", target: Target{Root: t.TempDir(), Home: home}},
+		{name: "session", target: Target{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			owner, err := test.target.owner()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (owner == nil) != (test.want == nil) || (owner != nil && *owner != *test.want) {
+				t.Errorf("owner is %v, want %v", owner, test.want)
+			}
+		})
+	}
+
+	// Applying into the home gives the new files to its owner
+	backend, err := openBackend(&Config{Defaults: DefaultsXML}, BackendAuto, Target{Home: home})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	profile := parseTestProfile(t, `{"properties": {"xfwm4": {"/general/theme": "Chicago95"}}}`)
+	if _, err := applyProperties(backend, profile, MergeHard, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	for path := filepath.Join(perchannelDir(filepath.Join(home, ".config")), "xfwm4.xml"); path != home; path = filepath.Dir(path) {
+		assertOwner(t, path, 1234)
+	}
+}
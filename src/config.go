@@ -16,6 +16,7 @@ import (
 var defaultConfig []byte
 
 type MergeBehavior string
+type DefaultsMode string
 type ExcludePatterns map[string]*regexp.Regexp
 
 const (
@@ -24,6 +25,11 @@ const (
 	MergeForce MergeBehavior = "force"
 )
 
+const (
+	DefaultsXML     DefaultsMode = "xml"
+	DefaultsXfconfd DefaultsMode = "xfconfd"
+)
+
 func (ep *ExcludePatterns) IsExcluded(channel string, property string) bool {
 	representation := fmt.Sprintf("%s%s", channel, property)
 	for _, re := range *ep {
@@ -37,10 +43,12 @@ func (ep *ExcludePatterns) IsExcluded(channel string, property string) bool {
 type Config struct {
 	Version int `yaml:"version"`
 	Sync    struct {
-		Auto bool `yaml:"auto"`
+		Auto    bool `yaml:"auto"`
+		History int  `yaml:"history"`
 	} `yaml:"sync"`
-	Merge   MergeBehavior   `yaml:"merge"`
-	Exclude ExcludePatterns `yaml:"exclude"`
+	Merge    MergeBehavior   `yaml:"merge"`
+	Exclude  ExcludePatterns `yaml:"exclude"`
+	Defaults DefaultsMode    `yaml:"defaults"`
 }
 
 func ParseMergeBehavior(value string) (MergeBehavior, error) {
@@ -71,6 +79,32 @@ func (m *MergeBehavior) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
+func ParseDefaultsMode(value string) (DefaultsMode, error) {
+	switch strings.ToLower(value) {
+	case "xml":
+		return DefaultsXML, nil
+	case "xfconfd":
+		return DefaultsXfconfd, nil
+	default:
+		return "", errors.New("invalid defaults mode: must be 'xml' or 'xfconfd'")
+	}
+}
+
+func (m *DefaultsMode) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw string
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	parsed, err := ParseDefaultsMode(raw)
+	if err != nil {
+		return err
+	}
+
+	*m = parsed
+	return nil
+}
+
 func (m *ExcludePatterns) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	var patternStrings []string
 	if err := unmarshal(&patternStrings); err != nil {
@@ -78,7 +112,16 @@ func (m *ExcludePatterns) UnmarshalYAML(unmarshal func(interface{}) error) error
 	}
 
 	patterns := make(ExcludePatterns)
+	if err := patterns.add(patternStrings); err != nil {
+		return err
+	}
+
+	*m = patterns
+	return nil
+}
 
+// Add patterns on top of the ones already there
+func (m ExcludePatterns) add(patternStrings []string) error {
 	for _, pattern := range patternStrings {
 		// Compile the regular expression for each pattern
 		re, err := regexp.Compile(pattern)
@@ -86,14 +129,12 @@ func (m *ExcludePatterns) UnmarshalYAML(unmarshal func(interface{}) error) error
 			return fmt.Errorf("invalid exclude regular expression: %s", pattern)
 		}
 
-		patterns[pattern] = re
+		m[pattern] = re
 	}
-
-	*m = patterns
 	return nil
 }
 
-func getConfigPath() string {
+func xdgConfigHome() string {
 	xdgConfigHome := os.Getenv("XDG_CONFIG_HOME")
 	if xdgConfigHome == "" {
 		home, err := os.UserHomeDir()
@@ -103,7 +144,16 @@ func getConfigPath() string {
 		}
 		xdgConfigHome = filepath.Join(home, ".config")
 	}
-	return filepath.Join(xdgConfigHome, "xfconf-profile", "config.yml")
+	return xdgConfigHome
+}
+
+func getConfigPath() string {
+	return filepath.Join(xdgConfigHome(), "xfconf-profile", "config.yml")
+}
+
+// The user's profile that sync applies on top of the distribution's
+func getOverridesPath() string {
+	return filepath.Join(xdgConfigHome(), "xfconf-profile", "overrides.json")
 }
 
 func loadConfig() (*Config, error) {
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/godbus/dbus/v5"
+)
+
+const (
+	xfconfBusName    = "org.xfce.Xfconf"
+	xfconfObjectPath = "/org/xfce/Xfconf"
+	xfconfInterface  = "org.xfce.Xfconf"
+)
+
+// Errors returned by xfconfd when a property or channel does not exist
+var xfconfNotFoundErrors = map[string]bool{
+	"org.xfce.Xfconf.Error.PropertyNotFound": true,
+	"org.xfce.Xfconf.Error.ChannelNotFound":  true,
+}
+
+// XfconfDBus talks to xfconfd's org.xfce.Xfconf interface over a single D-Bus connection
+type XfconfDBus struct {
+	DefaultsSource
+
+	conn *dbus.Conn
+	obj  dbus.BusObject
+}
+
+// NewXfconfDBus uses an existing connection to reach xfconfd. This allows pointing it at any bus,
+// such as a private one with a fake xfconfd.
+func NewXfconfDBus(conn *dbus.Conn) *XfconfDBus {
+	return &XfconfDBus{
+		conn: conn,
+		obj:  conn.Object(xfconfBusName, xfconfObjectPath),
+	}
+}
+
+// ConnectXfconfDBus opens a connection to the session bus and checks that xfconfd is running or
+// can be activated on it.
+func ConnectXfconfDBus() (*XfconfDBus, error) {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to session bus: %v", err)
+	}
+
+	available, err := isXfconfdAvailable(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !available {
+		conn.Close()
+		return nil, fmt.Errorf("%s is not available on the session bus", xfconfBusName)
+	}
+
+	return NewXfconfDBus(conn), nil
+}
+
+func isXfconfdAvailable(conn *dbus.Conn) (bool, error) {
+	var hasOwner bool
+	if err := conn.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, xfconfBusName).Store(&hasOwner); err != nil {
+		return false, fmt.Errorf("failed to look up %s: %v", xfconfBusName, err)
+	}
+	if hasOwner {
+		return true, nil
+	}
+
+	var activatable []string
+	if err := conn.BusObject().Call("org.freedesktop.DBus.ListActivatableNames", 0).Store(&activatable); err != nil {
+		return false, fmt.Errorf("failed to list activatable services: %v", err)
+	}
+	for _, name := range activatable {
+		if name == xfconfBusName {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+func (x *XfconfDBus) Close() error {
+	return x.conn.Close()
+}
+
+// Get returns the value of a property and whether it exists
+func (x *XfconfDBus) Get(channel, property string) (Value, bool, error) {
+	var variant dbus.Variant
+	err := x.obj.Call(xfconfInterface+".GetProperty", 0, channel, property).Store(&variant)
+	if isNotFound(err) {
+		return Value{}, false, nil
+	}
+	if err != nil {
+		return Value{}, false, fmt.Errorf("failed to get %s%s: %v", channel, property, err)
+	}
+
+	value, err := valueFromVariant(variant)
+	if err != nil {
+		return Value{}, false, fmt.Errorf("failed to read %s%s: %v", channel, property, err)
+	}
+	return value, true, nil
+}
+
+// GetAll returns every property of a channel below the given base property
+func (x *XfconfDBus) GetAll(channel, base string) (map[string]Value, error) {
+	var variants map[string]dbus.Variant
+	err := x.obj.Call(xfconfInterface+".GetAllProperties", 0, channel, base).Store(&variants)
+	if isNotFound(err) {
+		return map[string]Value{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get properties of %s: %v", channel, err)
+	}
+
+	values := make(map[string]Value)
+	for property, variant := range variants {
+		value, err := valueFromVariant(variant)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %s%s: %v", channel, property, err)
+		}
+		values[property] = value
+	}
+	return values, nil
+}
+
+func (x *XfconfDBus) List(channel string) (map[string]Value, error) {
+	return x.GetAll(channel, "/")
+}
+
+func (x *XfconfDBus) Set(channel, property string, value Value) error {
+	variant, err := variantFromValue(value)
+	if err != nil {
+		return fmt.Errorf("cannot set %s%s: %v", channel, property, err)
+	}
+
+	if err := x.obj.Call(xfconfInterface+".SetProperty", 0, channel, property, variant).Err; err != nil {
+		return fmt.Errorf("failed to set %s%s: %v", channel, property, err)
+	}
+	return nil
+}
+
+func (x *XfconfDBus) Reset(channel, property string, recursive bool) error {
+	err := x.obj.Call(xfconfInterface+".ResetProperty", 0, channel, property, recursive).Err
+	if err != nil && !isNotFound(err) {
+		return fmt.Errorf("failed to reset %s%s: %v", channel, property, err)
+	}
+	return nil
+}
+
+func isNotFound(err error) bool {
+	var dbusErr dbus.Error
+	return errors.As(err, &dbusErr) && xfconfNotFoundErrors[dbusErr.Name]
+}
+
+// Convert a value to the variant xfconfd expects for its type
+func variantFromValue(value Value) (dbus.Variant, error) {
+	if value.Type == "array" {
+		items := make([]dbus.Variant, len(value.Items))
+		for i, item := range value.Items {
+			variant, err := variantFromValue(item)
+			if err != nil {
+				return dbus.Variant{}, err
+			}
+			items[i] = variant
+		}
+		return dbus.MakeVariant(items), nil
+	}
+
+	if err := validateScalar(value.Type, value.Value); err != nil {
+		return dbus.Variant{}, err
+	}
+
+	// The value has been validated, so parsing cannot fail below
+	switch value.Type {
+	case "string":
+		return dbus.MakeVariant(value.Value), nil
+	case "bool":
+		v, _ := strconv.ParseBool(value.Value)
+		return dbus.MakeVariant(v), nil
+	case "int":
+		v, _ := strconv.ParseInt(value.Value, 10, 32)
+		return dbus.MakeVariant(int32(v)), nil
+	case "uint":
+		v, _ := strconv.ParseUint(value.Value, 10, 32)
+		return dbus.MakeVariant(uint32(v)), nil
+	case "int64":
+		v, _ := strconv.ParseInt(value.Value, 10, 64)
+		return dbus.MakeVariant(v), nil
+	case "uint64":
+		v, _ := strconv.ParseUint(value.Value, 10, 64)
+		return dbus.MakeVariant(v), nil
+	case "int16":
+		v, _ := strconv.ParseInt(value.Value, 10, 16)
+		return dbus.MakeVariant(int16(v)), nil
+	case "uint16":
+		v, _ := strconv.ParseUint(value.Value, 10, 16)
+		return dbus.MakeVariant(uint16(v)), nil
+	case "char":
+		v, _ := strconv.ParseInt(value.Value, 10, 8)
+		return dbus.MakeVariant(byte(int8(v))), nil
+	case "uchar":
+		v, _ := strconv.ParseUint(value.Value, 10, 8)
+		return dbus.MakeVariant(byte(v)), nil
+	default:
+		// D-Bus has no single precision type, so floats travel as doubles
+		v, _ := strconv.ParseFloat(value.Value, 64)
+		return dbus.MakeVariant(v), nil
+	}
+}
+
+// Convert a variant received from xfconfd to a typed value
+func valueFromVariant(variant dbus.Variant) (Value, error) {
+	switch v := variant.Value().(type) {
+	case string:
+		return Value{Type: "string", Value: v}, nil
+	case bool:
+		return Value{Type: "bool", Value: strconv.FormatBool(v)}, nil
+	case int32:
+		return Value{Type: "int", Value: strconv.FormatInt(int64(v), 10)}, nil
+	case uint32:
+		return Value{Type: "uint", Value: strconv.FormatUint(uint64(v), 10)}, nil
+	case int64:
+		return Value{Type: "int64", Value: strconv.FormatInt(v, 10)}, nil
+	case uint64:
+		return Value{Type: "uint64", Value: strconv.FormatUint(v, 10)}, nil
+	case int16:
+		return Value{Type: "int16", Value: strconv.FormatInt(int64(v), 10)}, nil
+	case uint16:
+		return Value{Type: "uint16", Value: strconv.FormatUint(uint64(v), 10)}, nil
+	case byte:
+		return Value{Type: "uchar", Value: strconv.FormatUint(uint64(v), 10)}, nil
+	case float64:
+		return Value{Type: "double", Value: strconv.FormatFloat(v, 'f', -1, 64)}, nil
+	case []dbus.Variant:
+		array := Value{Type: "array", Items: []Value{}}
+		for _, item := range v {
+			element, err := valueFromVariant(item)
+			if err != nil {
+				return Value{}, err
+			}
+			array.Items = append(array.Items, element)
+		}
+		return array, nil
+	default:
+		return Value{}, fmt.Errorf("unsupported D-Bus type %s", variant.Signature())
+	}
+}
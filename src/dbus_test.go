@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bufio"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// Start a private session bus and return its address. The test is skipped when dbus-daemon is
+// not installed.
+func startTestBus(t *testing.T) string {
+	t.Helper()
+
+	daemon, err := exec.LookPath("dbus-daemon")
+	if err != nil {
+		t.Skip("dbus-daemon is not installed")
+	}
+
+	cmd := exec.Command(daemon, "--session", "--nofork", "--print-address=1")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start dbus-daemon: %v", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+
+	address, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed to read the bus address: %v", err)
+	}
+	return strings.TrimSpace(address)
+}
+
+func connectTestBus(t *testing.T, address string) *dbus.Conn {
+	t.Helper()
+
+	conn, err := dbus.Connect(address)
+	if err != nil {
+		t.Fatalf("failed to connect to %s: %v", address, err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// fakeXfconfd serves the part of org.xfce.Xfconf used by XfconfDBus from memory. Its methods are
+// called from the connection's goroutine, so the test reads and writes properties through lookup
+// and store.
+type fakeXfconfd struct {
+	mu       sync.Mutex
+	channels map[string]map[string]dbus.Variant
+}
+
+func (f *fakeXfconfd) lookup(channel, property string) (dbus.Variant, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	value, ok := f.channels[channel][property]
+	return value, ok
+}
+
+func (f *fakeXfconfd) store(channel string, properties map[string]dbus.Variant) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.channels[channel] = properties
+}
+
+func (f *fakeXfconfd) count(channel string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.channels[channel])
+}
+
+func notFound(channel, property string) *dbus.Error {
+	return dbus.NewError("org.xfce.Xfconf.Error.PropertyNotFound", []any{"Property \"" + property + "\" does not exist on channel \"" + channel + "\""})
+}
+
+func (f *fakeXfconfd) GetProperty(channel, property string) (dbus.Variant, *dbus.Error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	value, ok := f.channels[channel][property]
+	if !ok {
+		return dbus.Variant{}, notFound(channel, property)
+	}
+	return value, nil
+}
+
+func (f *fakeXfconfd) GetAllProperties(channel, base string) (map[string]dbus.Variant, *dbus.Error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	properties, ok := f.channels[channel]
+	if !ok {
+		return nil, dbus.NewError("org.xfce.Xfconf.Error.ChannelNotFound", []any{"Channel \"" + channel + "\" does not exist"})
+	}
+
+	values := make(map[string]dbus.Variant)
+	for property, value := range properties {
+		if base == "/" || property == base || isBelow(property, base) {
+			values[property] = value
+		}
+	}
+	return values, nil
+}
+
+func (f *fakeXfconfd) SetProperty(channel, property string, value dbus.Variant) *dbus.Error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.channels[channel] == nil {
+		f.channels[channel] = make(map[string]dbus.Variant)
+	}
+	f.channels[channel][property] = value
+	return nil
+}
+
+func (f *fakeXfconfd) ResetProperty(channel, property string, recursive bool) *dbus.Error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if _, ok := f.channels[channel][property]; !ok && !recursive {
+		return notFound(channel, property)
+	}
+	for name := range f.channels[channel] {
+		if name == property || (recursive && isBelow(name, property)) {
+			delete(f.channels[channel], name)
+		}
+	}
+	return nil
+}
+
+// Start a fake xfconfd on a private bus and connect an XfconfDBus to it
+func startFakeXfconfd(t *testing.T) (*fakeXfconfd, *XfconfDBus) {
+	t.Helper()
+	address := startTestBus(t)
+
+	fake := &fakeXfconfd{channels: make(map[string]map[string]dbus.Variant)}
+	server := connectTestBus(t, address)
+	if err := server.Export(fake, xfconfObjectPath, xfconfInterface); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.RequestName(xfconfBusName, dbus.NameFlagDoNotQueue); err != nil {
+		t.Fatal(err)
+	}
+
+	return fake, NewXfconfDBus(connectTestBus(t, address))
+}
+
+func TestXfconfDBusGetSetReset(t *testing.T) {
+	fake, bus := startFakeXfconfd(t)
+	fake.store("xfwm4", map[string]dbus.Variant{
+		"/general/theme":        dbus.MakeVariant("Default"),
+		"/general/button_count": dbus.MakeVariant(int32(3)),
+	})
+	fake.store("xfce4-panel", map[string]dbus.Variant{
+		"/plugins/plugin-1":      dbus.MakeVariant("clock"),
+		"/plugins/plugin-1/mode": dbus.MakeVariant(uint32(2)),
+		"/plugins/plugin-2":      dbus.MakeVariant("menu"),
+	})
+
+	value, ok, err := bus.Get("xfwm4", "/general/theme")
+	if err != nil || !ok || value.Type != "string" || value.Value != "Default" {
+		t.Errorf("Get(/general/theme) = %v, %v, %v", value, ok, err)
+	}
+
+	_, ok, err = bus.Get("xfwm4", "/general/missing")
+	if err != nil || ok {
+		t.Errorf("Get(/general/missing) = %v, %v, want not found without error", ok, err)
+	}
+
+	values, err := bus.GetAll("xfce4-panel", "/plugins/plugin-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Value{
+		"/plugins/plugin-1":      {Type: "string", Value: "clock"},
+		"/plugins/plugin-1/mode": {Type: "uint", Value: "2"},
+	}
+	if len(values) != len(want) {
+		t.Errorf("GetAll(/plugins/plugin-1) = %v, want %v", values, want)
+	}
+	for property, value := range want {
+		if !values[property].Equal(value) {
+			t.Errorf("GetAll(/plugins/plugin-1)[%s] = %v, want %v", property, values[property], value)
+		}
+	}
+
+	values, err = bus.List("missing-channel")
+	if err != nil || len(values) != 0 {
+		t.Errorf("List(missing-channel) = %v, %v, want no properties without error", values, err)
+	}
+
+	if err := bus.Set("xfwm4", "/general/theme", Value{Type: "string", Value: "Chicago95"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := fake.lookup("xfwm4", "/general/theme"); got.Value() != "Chicago95" {
+		t.Errorf("after Set, xfconfd has %v", got)
+	}
+
+	if err := bus.Set("xfwm4", "/general/button_count", Value{Type: "int", Value: "many"}); err == nil {
+		t.Error("Set accepted an invalid int")
+	}
+
+	if err := bus.Reset("xfwm4", "/general/theme", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fake.lookup("xfwm4", "/general/theme"); ok {
+		t.Error("Reset left /general/theme set")
+	}
+	if err := bus.Reset("xfwm4", "/general/theme", false); err != nil {
+		t.Errorf("Reset of a missing property failed: %v", err)
+	}
+
+	if err := bus.Reset("xfce4-panel", "/plugins/plugin-1", true); err != nil {
+		t.Fatal(err)
+	}
+	if count := fake.count("xfce4-panel"); count != 1 {
+		t.Errorf("recursive Reset left %d properties, want 1", count)
+	}
+}
+
+func TestXfconfDBusValueRoundTrip(t *testing.T) {
+	fake, bus := startFakeXfconfd(t)
+
+	tests := []struct {
+		value Value
+		// The D-Bus type xfconfd receives
+		signature string
+		// What reading the property back gives, when it differs from the value set
+		readBack *Value
+	}{
+		{value: Value{Type: "string", Value: "Chicago95"}, signature: "s"},
+		{value: Value{Type: "bool", Value: "true"}, signature: "b"},
+		{value: Value{Type: "int", Value: "-42"}, signature: "i"},
+		{value: Value{Type: "uint", Value: "42"}, signature: "u"},
+		{value: Value{Type: "int64", Value: "-9000000000"}, signature: "x"},
+		{value: Value{Type: "uint64", Value: "9000000000"}, signature: "t"},
+		{value: Value{Type: "int16", Value: "-7"}, signature: "n"},
+		{value: Value{Type: "uint16", Value: "7"}, signature: "q"},
+		{value: Value{Type: "uchar", Value: "200"}, signature: "y"},
+		{value: Value{Type: "double", Value: "1.5"}, signature: "d"},
+		// D-Bus has a single byte type, and no single precision floats
+		{value: Value{Type: "char", Value: "-5"}, signature: "y", readBack: &Value{Type: "uchar", Value: "251"}},
+		{value: Value{Type: "float", Value: "0.25"}, signature: "d", readBack: &Value{Type: "double", Value: "0.25"}},
+		{
+			value: Value{Type: "array", Items: []Value{
+				{Type: "int", Value: "1"},
+				{Type: "string", Value: "two"},
+			}},
+			signature: "av",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value.Type, func(t *testing.T) {
+			if err := bus.Set("test", "/value", test.value); err != nil {
+				t.Fatal(err)
+			}
+			received, _ := fake.lookup("test", "/value")
+			if got := received.Signature().String(); got != test.signature {
+				t.Errorf("xfconfd received %s, want %s", got, test.signature)
+			}
+
+			want := test.value
+			if test.readBack != nil {
+				want = *test.readBack
+			}
+			got, ok, err := bus.Get("test", "/value")
+			if err != nil || !ok {
+				t.Fatalf("Get = %v, %v", ok, err)
+			}
+			if got.Type != want.Type || !got.Equal(want) {
+				t.Errorf("read back %s %v, want %s %v", got.Type, got, want.Type, want)
+			}
+		})
+	}
+}
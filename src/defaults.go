@@ -2,27 +2,32 @@ package main
 
 import (
 	"bufio"
-	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
 	"time"
+
+	"github.com/fatih/color"
 )
 
+// Printed after each query sent to the throwaway session since results can span several lines
+const endOfQueryMarker = "--xfconf-profile-end-of-query--"
+
 // xfconf-query does not have a simple way to get the default value for a given property. The best we can do here
 // is to start a throwaway xfconfd whose config is set to the default config provided by the distribution in
-// /usr/etc/xdg (or /etc/xdg for non-atomic distros).
+// the first existing directory of $XDG_CONFIG_DIRS.
 //
 // We'll start an instance of xfconfd in a throwaway D-Bus session isolated from the user's session and call
 // xfconf-query inside of that session.
 func gatherDefaultPropertyValuesFromConfig(queries map[string][]string, configDir string) (map[string]map[string]string, error) {
-	xfconfdPath := "/usr/lib64/xfce4/xfconf/xfconfd"
-	_, err := os.Stat(xfconfdPath)
+	xfconfdPath, err := findXfconfd()
 	if err != nil {
-		return nil, fmt.Errorf("no xfconfd found at %s", xfconfdPath)
+		return nil, err
 	}
 
 	logger.Debug("Using config dir", "XDG_CONFIG_HOME", configDir)
@@ -65,7 +70,7 @@ func gatherDefaultPropertyValuesFromConfig(queries map[string][]string, configDi
 		results[channel] = make(map[string]string)
 
 		for _, property := range properties {
-			queryCmd := fmt.Sprintf("xfconf-query --channel %q --property %q 2>&1\n", channel, property)
+			queryCmd := fmt.Sprintf("xfconf-query --channel %q --property %q 2>&1; echo %s\n", channel, property, endOfQueryMarker)
 
 			// Send query to running shell
 			_, err := stdin.Write([]byte(queryCmd))
@@ -73,8 +78,11 @@ func gatherDefaultPropertyValuesFromConfig(queries map[string][]string, configDi
 				return nil, fmt.Errorf("failed to write to dbus-run-session: %v", err)
 			}
 
-			scanner.Scan()
-			queryResult := scanner.Text()
+			var lines []string
+			for scanner.Scan() && scanner.Text() != endOfQueryMarker {
+				lines = append(lines, scanner.Text())
+			}
+			queryResult := strings.Join(lines, "\n")
 			if strings.Contains(queryResult, "does not exist on channel") {
 				results[channel][property] = "" // Handle missing properties
 			} else {
@@ -95,63 +103,242 @@ func gatherDefaultPropertyValuesFromConfig(queries map[string][]string, configDi
 	return results, nil
 }
 
-func gatherDefaultPropertyValues(queries map[string][]string) (map[string]map[string]string, error) {
+// Locations of xfconfd on the distributions we know about
+var xfconfdPaths = []string{
+	"/usr/lib64/xfce4/xfconf/xfconfd",
+	"/usr/lib/xfce4/xfconf/xfconfd",
+	"/usr/lib/x86_64-linux-gnu/xfce4/xfconf/xfconfd",
+	"/usr/libexec/xfce4/xfconf/xfconfd",
+}
+
+func findXfconfd() (string, error) {
+	for _, xfconfdPath := range xfconfdPaths {
+		if _, err := os.Stat(xfconfdPath); err == nil {
+			return xfconfdPath, nil
+		}
+	}
+	return "", fmt.Errorf("no xfconfd found in %s", strings.Join(xfconfdPaths, ", "))
+}
+
+// The source of default values for the system's Xfce installation
+func systemDefaults(mode DefaultsMode) DefaultsSource {
+	if mode == DefaultsXfconfd {
+		return xfconfdDefaults{}
+	}
+	return newXMLDefaults(xdgConfigDirs())
+}
+
+// The source of default values for a system image, read from its own config directories
+func rootDefaults(root string) DefaultsSource {
+	var configDirs []string
+	for _, dir := range xdgConfigDirs() {
+		configDirs = append(configDirs, filepath.Join(root, dir))
+	}
+	return newXMLDefaults(configDirs)
+}
+
+// xmlDefaults finds default values by reading perchannel XML files, like xfconfd does
+type xmlDefaults struct {
+	// Perchannel XML directories, ordered from lowest to highest precedence
+	dirs []string
+}
+
+// Read the defaults from system config directories ordered from highest to lowest precedence
+func newXMLDefaults(configDirs []string) xmlDefaults {
+	// Parse from lowest to highest precedence so that properties from the more important
+	// directories override the others
+	var dirs []string
+	for i := len(configDirs) - 1; i >= 0; i-- {
+		dirs = append(dirs, perchannelDir(configDirs[i]))
+	}
+	return xmlDefaults{dirs: dirs}
+}
+
+func (d xmlDefaults) Defaults(queries map[string][]string) (map[string]map[string]Value, error) {
+	xfconf, err := newXfconfFromDirs(d.dirs...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read default settings: %v", err)
+	}
+
+	results := make(map[string]map[string]Value)
+	for channel, properties := range queries {
+		results[channel] = make(map[string]Value)
+		for _, property := range properties {
+			if value, ok := xfconf.Value(channel, property); ok {
+				results[channel][property] = value
+			}
+		}
+	}
+
+	return results, nil
+}
+
+// The system config directories from $XDG_CONFIG_DIRS, ordered from highest to lowest precedence
+func xdgConfigDirs() []string {
 	// Special case to use the test's default values if running end-to-end-test
 	_, underTest := os.LookupEnv("XFCONF_PROFILE_END_TO_END_TEST")
 	if underTest {
-		cwd, err := os.Getwd()
-		if err != nil {
-			return nil, fmt.Errorf("Cannot get working directory")
+		if cwd, err := os.Getwd(); err == nil {
+			return []string{filepath.Join(cwd, "..", "etc", "xdg")}
+		}
+	}
+
+	var dirs []string
+	for _, dir := range filepath.SplitList(os.Getenv("XDG_CONFIG_DIRS")) {
+		if filepath.IsAbs(dir) {
+			dirs = append(dirs, dir)
 		}
-		testConfigDir := filepath.Join(cwd, "..", "etc", "xdg")
-		return gatherDefaultPropertyValuesFromConfig(queries, testConfigDir)
 	}
 
-	configDir := "/usr/etc/xdg"
+	if len(dirs) == 0 {
+		// Atomic distributions ship their defaults in /usr/etc/xdg, which /etc/xdg overrides
+		dirs = []string{"/etc/xdg", "/usr/etc/xdg"}
+	}
+
+	return dirs
+}
+
+// xfconfdDefaults finds default values by asking a throwaway xfconfd configured with only the
+// distribution's settings
+type xfconfdDefaults struct{}
+
+func (xfconfdDefaults) Defaults(queries map[string][]string) (map[string]map[string]Value, error) {
+	configDir, err := defaultConfigDir()
+	if err != nil {
+		return nil, err
+	}
 
-	_, err := os.Stat(configDir)
+	outputs, err := gatherDefaultPropertyValuesFromConfig(queries, configDir)
 	if err != nil {
-		configDir = "/etc/xdg"
+		return nil, err
 	}
 
-	_, err = os.Stat(configDir)
+	// xfconf-query does not print types, but the distribution's XML files have them
+	types, err := newXfconfFromDirs(perchannelDir(configDir))
 	if err != nil {
-		return nil, fmt.Errorf("no xdg directories available - is Xfce installed?")
+		return nil, fmt.Errorf("failed to read default settings: %v", err)
 	}
 
-	return gatherDefaultPropertyValuesFromConfig(queries, configDir)
+	results := make(map[string]map[string]Value)
+	for channel, properties := range outputs {
+		results[channel] = make(map[string]Value)
+		for property, output := range properties {
+			if output == "" {
+				continue
+			}
+
+			value := parseQueryOutput(output)
+			if typed, ok := types.Value(channel, property); ok {
+				value = value.withTypesFrom(typed)
+			}
+			results[channel][property] = value
+		}
+	}
+
+	return results, nil
 }
 
-func gatherCurrentPropertyValues(queries map[string][]string) (map[string]map[string]any, error) {
-	results := make(map[string]map[string]any)
+// Find the directory holding the distribution's default Xfce settings
+func defaultConfigDir() (string, error) {
+	for _, configDir := range xdgConfigDirs() {
+		if _, err := os.Stat(configDir); err == nil {
+			return configDir, nil
+		}
+	}
 
-	for channel, properties := range queries {
-		results[channel] = make(map[string]any)
+	return "", fmt.Errorf("no xdg directories available - is Xfce installed?")
+}
 
-		for _, property := range properties {
-			cmd := exec.Command("xfconf-query", "--channel", channel, "--property", property)
+// The perchannel XML directories of the system config directories, ordered from highest to lowest
+// precedence
+func systemPerchannelDirs() []string {
+	var dirs []string
+	for _, dir := range xdgConfigDirs() {
+		dirs = append(dirs, perchannelDir(dir))
+	}
+	return dirs
+}
 
-			var stdout, stderr bytes.Buffer
-			cmd.Stdout = &stdout
-			cmd.Stderr = &stderr
+// Merge a profile into the vendor's perchannel XML files and write the channels it changes to the
+// output directory. The result can be shipped as the system-wide defaults of a distribution. Each
+// channel is read from the first of the vendor directories that has it, so they are ordered from
+// highest to lowest precedence.
+func buildDefaults(profilePath string, vendorDirs []string, outputDir string) error {
+	outputAbs, err := filepath.Abs(outputDir)
+	if err != nil {
+		return err
+	}
+	for _, vendorDir := range vendorDirs {
+		vendorAbs, err := filepath.Abs(vendorDir)
+		if err != nil {
+			return err
+		}
+		if vendorAbs == outputAbs {
+			return fmt.Errorf("output directory must differ from the vendor directory")
+		}
+	}
 
-			err := cmd.Run()
+	profile, err := loadProfile(profilePath)
+	if err != nil {
+		return err
+	}
 
+	// Resetting a property to its default means keeping the vendor's value here. Only removals
+	// take properties out of the vendor's defaults.
+	yellow := color.New(color.FgHiYellow).SprintFunc()
+	for channel, properties := range profile.Properties.queries() {
+		for _, property := range properties {
+			entry, err := parseProfileEntry(profile.Properties[channel][property], "")
 			if err != nil {
-				// If there was an error (property not found)
-				results[channel][property] = ""
-				continue
+				return fmt.Errorf("invalid value for property %s%s: %v", channel, property, err)
+			}
+			if entry.Action == ActionReset {
+				fmt.Printf("%s Keeping the vendor's default of %s%s\n", yellow("•"), channel, property)
+				delete(profile.Properties[channel], property)
 			}
+		}
+	}
 
-			// Read the output value
-			scanner := bufio.NewScanner(&stdout)
-			if scanner.Scan() {
-				results[channel][property] = scanner.Text()
-			} else {
-				results[channel][property] = ""
+	// Start each channel from the vendor's copy, or from scratch if it has none. Files left in the
+	// output directory by an earlier build are replaced.
+	for channel := range profile.Properties.queries() {
+		outputFile := filepath.Join(outputDir, channel+".xml")
+		vendorChannel, err := readVendorChannel(vendorDirs, channel)
+		if err != nil {
+			return err
+		}
+		if vendorChannel == nil {
+			if err := os.Remove(outputFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return fmt.Errorf("failed to remove %s: %v", outputFile, err)
 			}
+			continue
+		}
+		if err := vendorChannel.write(outputFile); err != nil {
+			return err
 		}
 	}
 
-	return results, nil
+	// The profile is the distribution's choice, so it is applied as is
+	backend := NewXfconfXML(outputDir, newVendorDefaults(vendorDirs))
+	_, err = applyProperties(backend, profile, MergeForce, nil, false)
+	return err
+}
+
+// Read a channel from the first vendor directory that has it, or nil if none does
+func readVendorChannel(vendorDirs []string, channel string) (*Channel, error) {
+	for _, vendorDir := range vendorDirs {
+		vendorChannel, err := readChannel(filepath.Join(vendorDir, channel+".xml"))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		return vendorChannel, err
+	}
+	return nil, nil
+}
+
+// The defaults of perchannel XML directories ordered from highest to lowest precedence
+func newVendorDefaults(vendorDirs []string) xmlDefaults {
+	dirs := slices.Clone(vendorDirs)
+	slices.Reverse(dirs)
+	return xmlDefaults{dirs: dirs}
 }
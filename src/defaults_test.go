@@ -0,0 +1,189 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Check the properties stored in a perchannel XML directory
+func assertChannel(t *testing.T, dir, channel string, want testValues) {
+	t.Helper()
+
+	values, err := NewXfconfXML(dir, nil).List(channel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(testValues)
+	for property, value := range values {
+		got[channel+property] = value
+	}
+
+	backend := NewMemoryBackend()
+	backend.Properties = got.byChannel()
+	assertProperties(t, backend, want)
+}
+
+const vendorXfwm4 = `<?xml version="1.0" encoding="UTF-8"?>
+
+<!-- Copyright the vendor -->
+
+<channel name="xfwm4" version="1.0">
+  <property name="general" type="empty">
+    <property name="theme" type="string" value="Default"/>
+    <property name="title_font" type="string" value="Sans Bold 9"/>
+    <property name="button_layout" type="string" value="O|SHMC"/>
+  </property>
+</channel>
+`
+
+const vendorXsettings = `<?xml version="1.0" encoding="UTF-8"?>
+
+<channel name="xsettings" version="1.0">
+  <property name="Net" type="empty">
+    <property name="ThemeName" type="string" value="Adwaita"/>
+  </property>
+</channel>
+`
+
+func TestBuildDefaults(t *testing.T) {
+	vendorDir := t.TempDir()
+	writeTestFile(t, filepath.Join(vendorDir, "xfwm4.xml"), vendorXfwm4)
+	writeTestFile(t, filepath.Join(vendorDir, "xsettings.xml"), vendorXsettings)
+	outputDir := filepath.Join(t.TempDir(), "xfconf")
+
+	profilePath := writeTestFile(t, filepath.Join(t.TempDir(), "profile.json"), `{"properties": {
+		"xfwm4": {
+			"/general/theme": "Chicago95",
+			"/general/title_font": null,
+			"/general/button_layout": {"action": "remove"}
+		},
+		"thunar": {"/last-view": "ThunarDetailsView"}
+	}}`)
+	if err := buildDefaults(profilePath, []string{vendorDir}, outputDir); err != nil {
+		t.Fatal(err)
+	}
+
+	// Resets keep the vendor's value and only removals take properties out
+	assertChannel(t, outputDir, "xfwm4", testValues{
+		"xfwm4/general/theme":      str("Chicago95"),
+		"xfwm4/general/title_font": str("Sans Bold 9"),
+	})
+	assertChannel(t, outputDir, "thunar", testValues{"thunar/last-view": str("ThunarDetailsView")})
+
+	data, err := os.ReadFile(filepath.Join(outputDir, "xfwm4.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "<!-- Copyright the vendor -->") {
+		t.Errorf("the vendor's header was dropped:\n%s", data)
+	}
+
+	// Channels the profile does not change are left to the vendor's files
+	if _, err := os.Stat(filepath.Join(outputDir, "xsettings.xml")); !os.IsNotExist(err) {
+		t.Error("xsettings.xml was written although the profile does not change it")
+	}
+}
+
+func TestBuildDefaultsReplacesEarlierBuilds(t *testing.T) {
+	vendorDir := t.TempDir()
+	writeTestFile(t, filepath.Join(vendorDir, "xfwm4.xml"), vendorXfwm4)
+	outputDir := t.TempDir()
+
+	for _, profile := range []string{
+		`{"properties": {"thunar": {"/a": "1"}, "xfwm4": {"/general/theme": "Chicago95"}}}`,
+		`{"properties": {"thunar": {"/b": "2"}, "xfwm4": {"/general/title_font": "Tahoma 8"}}}`,
+	} {
+		profilePath := writeTestFile(t, filepath.Join(t.TempDir(), "profile.json"), profile)
+		if err := buildDefaults(profilePath, []string{vendorDir}, outputDir); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	assertChannel(t, outputDir, "thunar", testValues{"thunar/b": str("2")})
+	assertChannel(t, outputDir, "xfwm4", testValues{
+		"xfwm4/general/theme":         str("Default"),
+		"xfwm4/general/title_font":    str("Tahoma 8"),
+		"xfwm4/general/button_layout": str("O|SHMC"),
+	})
+}
+
+func TestBuildDefaultsSearchesVendorDirs(t *testing.T) {
+	etc := t.TempDir()
+	usr := t.TempDir()
+	writeTestFile(t, filepath.Join(usr, "xfwm4.xml"), vendorXfwm4)
+	writeTestFile(t, filepath.Join(usr, "xsettings.xml"), vendorXsettings)
+	writeTestFile(t, filepath.Join(etc, "xsettings.xml"), strings.Replace(vendorXsettings, "Adwaita", "Greybird", 1))
+	outputDir := t.TempDir()
+
+	profilePath := writeTestFile(t, filepath.Join(t.TempDir(), "profile.json"), `{"properties": {
+		"xfwm4": {"/general/theme": "Chicago95"},
+		"xsettings": {"/Net/IconThemeName": "Chicago95"}
+	}}`)
+	if err := buildDefaults(profilePath, []string{etc, usr}, outputDir); err != nil {
+		t.Fatal(err)
+	}
+
+	assertChannel(t, outputDir, "xfwm4", testValues{
+		"xfwm4/general/theme":         str("Chicago95"),
+		"xfwm4/general/title_font":    str("Sans Bold 9"),
+		"xfwm4/general/button_layout": str("O|SHMC"),
+	})
+	assertChannel(t, outputDir, "xsettings", testValues{
+		"xsettings/Net/ThemeName":     str("Greybird"),
+		"xsettings/Net/IconThemeName": str("Chicago95"),
+	})
+
+	if err := buildDefaults(profilePath, []string{etc, usr}, usr); err == nil {
+		t.Error("building into a vendor directory was allowed")
+	}
+}
+
+func TestXMLDefaultsPrecedence(t *testing.T) {
+	first := t.TempDir()
+	second := t.TempDir()
+	writeTestFile(t, filepath.Join(perchannelDir(first), "xfwm4.xml"), strings.Replace(vendorXfwm4, "Default", "Chicago95", 1))
+	writeTestFile(t, filepath.Join(perchannelDir(second), "xfwm4.xml"), vendorXfwm4)
+	writeTestFile(t, filepath.Join(perchannelDir(second), "xsettings.xml"), vendorXsettings)
+	t.Setenv("XDG_CONFIG_DIRS", first+string(filepath.ListSeparator)+second)
+
+	defaults, err := systemDefaults(DefaultsXML).Defaults(map[string][]string{
+		"xfwm4":     {"/general/theme", "/general/title_font"},
+		"xsettings": {"/Net/ThemeName"},
+		"thunar":    {"/last-view"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The earlier directory wins, and channels it lacks come from the later one
+	backend := NewMemoryBackend()
+	backend.Properties = defaults
+	assertProperties(t, backend, testValues{
+		"xfwm4/general/theme":      str("Chicago95"),
+		"xfwm4/general/title_font": str("Sans Bold 9"),
+		"xsettings/Net/ThemeName":  str("Adwaita"),
+	})
+}
+
+func TestDefaultConfigDir(t *testing.T) {
+	existing := t.TempDir()
+	t.Setenv("XDG_CONFIG_DIRS", filepath.Join(existing, "missing")+string(filepath.ListSeparator)+existing)
+	if got, err := defaultConfigDir(); err != nil || got != existing {
+		t.Errorf("defaultConfigDir() = %q, %v, want %q", got, err, existing)
+	}
+
+	t.Setenv("XDG_CONFIG_DIRS", filepath.Join(existing, "missing"))
+	if _, err := defaultConfigDir(); err == nil {
+		t.Error("defaultConfigDir() found a missing directory")
+	}
+
+	// End-to-end tests use the defaults next to them
+	t.Setenv("XFCONF_PROFILE_END_TO_END_TEST", "1")
+	t.Chdir(existing)
+	want := filepath.Join(existing, "..", "etc", "xdg")
+	if got := xdgConfigDirs(); len(got) != 1 || got[0] != want {
+		t.Errorf("xdgConfigDirs() = %q under test, want %q", got, want)
+	}
+}
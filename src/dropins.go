@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const (
+	// File in a generation telling which file of the distribution each property came from
+	sourcesFile = "sources.json"
+	// The user's overrides as they were when synced
+	overridesFile = "overrides.json"
+)
+
+// DistProfile is the profile as synced: the distribution's main profile with the fragments of its
+// drop-in directory merged on top, and the user's overrides on top of everything. The
+// distribution's part and the overrides are kept apart, so that a change to either can be told
+// from a change to the other.
+type DistProfile struct {
+	// The distribution's part as it is stored in the state directory
+	Data []byte
+	Dist *Profile
+	// The user's overrides as they are stored in the state directory, if there are any
+	OverridesData []byte
+	Overrides     *Profile
+	// The distribution's part with the overrides on top
+	Profile *Profile
+	// The file of the distribution each property came from, for each channel
+	Sources map[string]map[string]string
+}
+
+// The drop-in directory of a profile, such as default.d for default.json
+func dropinDir(profilePath string) string {
+	return strings.TrimSuffix(profilePath, filepath.Ext(profilePath)) + ".d"
+}
+
+// The fragments of a drop-in directory in the order they are merged, by file name
+func dropinFragments(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", dir, err)
+	}
+
+	var fragments []string
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		fragments = append(fragments, filepath.Join(dir, entry.Name()))
+	}
+	slices.Sort(fragments)
+	return fragments, nil
+}
+
+// Load the distribution's profile. The fragments of its drop-in directory, such as
+// default.d/10-theme.json, are merged on top of it in file name order like systemd drop-ins: a
+// property in a later fragment replaces the same property from earlier ones. Either the profile or
+// its drop-in directory may be missing, but not both.
+func loadDistProfile(profilePath string) (*DistProfile, error) {
+	fragments, err := dropinFragments(dropinDir(profilePath))
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	if _, err := os.Stat(profilePath); err == nil || len(fragments) == 0 {
+		files = append(files, profilePath)
+	}
+	files = append(files, fragments...)
+
+	merged := newProfile()
+	sources := make(map[string]map[string]string)
+	for _, file := range files {
+		profile, err := loadProfile(file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load %s: %v", file, err)
+		}
+		merged.merge(profile)
+
+		for channel, properties := range profile.Properties {
+			if sources[channel] == nil {
+				sources[channel] = make(map[string]string)
+			}
+			for property := range properties {
+				sources[channel][property] = filepath.Base(file)
+			}
+		}
+	}
+
+	// A profile without fragments is kept as is
+	var data []byte
+	if len(fragments) == 0 {
+		data, err = os.ReadFile(profilePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read config: %v", err)
+		}
+	} else {
+		data, err = json.MarshalIndent(merged, "", "  ")
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode profile: %v", err)
+		}
+		data = append(data, '\n')
+	}
+
+	dist := &DistProfile{Data: data, Dist: merged, Sources: sources}
+	dist.setOverrides(newProfile(), nil)
+	return dist, nil
+}
+
+// Layer the user's overrides on top of the distribution's part, replacing the distribution's value
+// of every property they set. Overrides layered before are dropped, and a missing file means that
+// there are no overrides.
+func (d *DistProfile) addOverrides(overridesPath string) error {
+	data, err := os.ReadFile(overridesPath)
+	if errors.Is(err, os.ErrNotExist) {
+		d.setOverrides(newProfile(), nil)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", overridesPath, err)
+	}
+
+	overrides, err := loadProfile(overridesPath)
+	if err != nil {
+		return fmt.Errorf("failed to load %s: %v", overridesPath, err)
+	}
+	if len(overrides.Properties) == 0 {
+		d.setOverrides(newProfile(), nil)
+		return nil
+	}
+
+	d.setOverrides(overrides, data)
+	return nil
+}
+
+func (d *DistProfile) setOverrides(overrides *Profile, data []byte) {
+	d.Overrides = overrides
+	d.OverridesData = data
+
+	d.Profile = newProfile()
+	d.Profile.merge(d.Dist)
+	for channel, properties := range overrides.Properties {
+		if d.Profile.Properties[channel] == nil {
+			d.Profile.Properties[channel] = make(map[string]any)
+		}
+		for property, value := range properties {
+			d.Profile.Properties[channel][property] = value
+		}
+	}
+}
+
+// The properties set by the user's overrides
+func (d *DistProfile) forced() propertySet {
+	forced := make(propertySet)
+	for channel, properties := range d.Overrides.Properties.queries() {
+		for _, property := range properties {
+			forced.add(channel, property)
+		}
+	}
+	return forced
+}
+
+// Load the distribution's profile kept in a generation, along with the overrides it was synced with
+func loadGenerationProfile(dir string) (*DistProfile, error) {
+	path := origProfilePath(dir)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+
+	profile, err := loadProfile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	dist := &DistProfile{Data: data, Dist: profile}
+
+	sourcesData, err := os.ReadFile(filepath.Join(dir, sourcesFile))
+	if err == nil {
+		if err := json.Unmarshal(sourcesData, &dist.Sources); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %v", filepath.Join(dir, sourcesFile), err)
+		}
+	}
+
+	if err := dist.addOverrides(filepath.Join(dir, overridesFile)); err != nil {
+		return nil, err
+	}
+	return dist, nil
+}
+
+// Write the distribution's profile, the sources of its properties and the overrides into a state
+// directory
+func (d *DistProfile) save(stateDir string) error {
+	if err := os.WriteFile(filepath.Join(stateDir, origProfileFile), d.Data, 0644); err != nil {
+		return fmt.Errorf("failed to write current config: %v", err)
+	}
+
+	overridesPath := filepath.Join(stateDir, overridesFile)
+	if d.OverridesData != nil {
+		if err := os.WriteFile(overridesPath, d.OverridesData, 0644); err != nil {
+			return fmt.Errorf("failed to write overrides: %v", err)
+		}
+	} else if err := os.Remove(overridesPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove overrides: %v", err)
+	}
+
+	if d.Sources == nil {
+		return nil
+	}
+	data, err := json.MarshalIndent(d.Sources, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode sources: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(stateDir, sourcesFile), append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write sources: %v", err)
+	}
+	return nil
+}
+
+// Compare the distribution's part with a profile stored in a file. Profiles setting the same
+// properties to the same values are the same to sync, even if they are formatted differently or
+// their metadata changed. The second result tells whether the stored profile is exactly the same.
+func (d *DistProfile) compare(path string) (bool, bool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, false, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	if bytes.Equal(d.Data, data) {
+		return true, true, nil
+	}
+
+	stored, err := loadProfile(path)
+	if err != nil {
+		return false, false, err
+	}
+
+	return sameProperties(stored, d.Dist), false, nil
+}
+
+// Check whether two profiles set the same properties to the same values
+func sameProperties(a, b *Profile) bool {
+	delta := diffProfiles(a, b)
+	return len(delta.Updated.Properties) == 0 && len(delta.Dropped) == 0
+}
+
+// Add the properties and metadata of another profile, replacing the ones already there
+func (p *Profile) merge(other *Profile) {
+	for channel, properties := range other.Properties {
+		if p.Properties[channel] == nil {
+			p.Properties[channel] = make(map[string]any)
+		}
+		for property, value := range properties {
+			p.Properties[channel][property] = value
+		}
+	}
+
+	for key, value := range other.Metadata {
+		if p.Metadata == nil {
+			p.Metadata = make(map[string]any)
+		}
+		p.Metadata[key] = value
+	}
+}
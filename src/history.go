@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Number of generations kept when the config does not say
+const defaultSyncHistory = 5
+
+const (
+	generationFile = "generation.json"
+	// The distribution's profile that a rollback turned down, kept so that the next sync does
+	// not apply it again
+	skippedProfileFile = "profile.json.skipped"
+)
+
+// Generation is one version of the distribution's profile that was synced, along with what
+// syncing it changed
+type Generation struct {
+	Number int    `json:"-"`
+	Dir    string `json:"-"`
+
+	Created time.Time `json:"created"`
+	// The generation that was restored, if this generation was created by a rollback
+	RollbackOf int `json:"rollback_of,omitempty"`
+}
+
+func generationsDir(stateDir string) string {
+	return filepath.Join(stateDir, "generations")
+}
+
+func readGeneration(dir string, number int) (Generation, error) {
+	generation := Generation{Number: number, Dir: dir}
+
+	data, err := os.ReadFile(filepath.Join(dir, generationFile))
+	if errors.Is(err, os.ErrNotExist) {
+		// Generations migrated from older versions only have the time their directory changed
+		info, err := os.Stat(dir)
+		if err != nil {
+			return generation, err
+		}
+		generation.Created = info.ModTime()
+		return generation, nil
+	}
+	if err != nil {
+		return generation, fmt.Errorf("failed to read %s: %v", dir, err)
+	}
+
+	if err := json.Unmarshal(data, &generation); err != nil {
+		return generation, fmt.Errorf("failed to parse %s: %v", filepath.Join(dir, generationFile), err)
+	}
+	return generation, nil
+}
+
+// The directories of older versions, which only kept the current and previous state
+func legacyStateDirs(stateDir string) []string {
+	var dirs []string
+	for _, name := range []string{"previous", "current"} {
+		dir := filepath.Join(stateDir, name)
+		if _, err := os.Stat(origProfilePath(dir)); err == nil {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// List the generations in the state directory from oldest to newest. The state directories of
+// older versions are listed as generations as well, without moving them.
+func listGenerations(stateDir string) ([]Generation, error) {
+	entries, err := os.ReadDir(generationsDir(stateDir))
+	if errors.Is(err, os.ErrNotExist) {
+		var generations []Generation
+		for i, dir := range legacyStateDirs(stateDir) {
+			generation, err := readGeneration(dir, i+1)
+			if err != nil {
+				return nil, err
+			}
+			generations = append(generations, generation)
+		}
+		return generations, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read generations: %v", err)
+	}
+
+	var generations []Generation
+	for _, entry := range entries {
+		number, err := strconv.Atoi(entry.Name())
+		if err != nil || !entry.IsDir() {
+			continue
+		}
+
+		generation, err := readGeneration(filepath.Join(generationsDir(stateDir), entry.Name()), number)
+		if err != nil {
+			return nil, err
+		}
+		generations = append(generations, generation)
+	}
+
+	slices.SortFunc(generations, func(a, b Generation) int {
+		return a.Number - b.Number
+	})
+	return generations, nil
+}
+
+// Move the state directories of older versions into generations
+func migrateStateDir(stateDir string) error {
+	if _, err := os.Stat(generationsDir(stateDir)); err == nil {
+		return nil
+	}
+
+	if err := os.MkdirAll(generationsDir(stateDir), 0755); err != nil {
+		return fmt.Errorf("failed to create generations directory: %v", err)
+	}
+
+	for i, dir := range legacyStateDirs(stateDir) {
+		if err := os.Rename(dir, filepath.Join(generationsDir(stateDir), strconv.Itoa(i+1))); err != nil {
+			return fmt.Errorf("failed to migrate %s: %v", dir, err)
+		}
+	}
+
+	// Leftovers, such as a previous directory without a profile, are of no use anymore
+	for _, name := range []string{"previous", "current"} {
+		if err := os.RemoveAll(filepath.Join(stateDir, name)); err != nil {
+			return fmt.Errorf("failed to remove %s: %v", name, err)
+		}
+	}
+
+	return nil
+}
+
+// Read the generations of the sync state directory. Unless this is a dry run, the state
+// directories of older versions are migrated first.
+func openSyncState(dryRun bool) ([]Generation, error) {
+	stateDir, err := syncStateDir()
+	if err != nil {
+		return nil, err
+	}
+
+	if !dryRun {
+		if _, err := os.Stat(stateDir); err == nil {
+			if err := migrateStateDir(stateDir); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return listGenerations(stateDir)
+}
+
+// Record a new generation holding the synced profile and what syncing it changed, then drop the
+// oldest generations beyond the number to keep
+func saveGeneration(dist *DistProfile, changes *AppliedChanges, rollbackOf int, skipped string, history int) (*Generation, error) {
+	stateDir, err := ensureStateDir()
+	if err != nil {
+		return nil, err
+	}
+
+	generations, err := listGenerations(stateDir)
+	if err != nil {
+		return nil, err
+	}
+
+	number := 1
+	if len(generations) > 0 {
+		number = generations[len(generations)-1].Number + 1
+	}
+
+	generation := &Generation{
+		Number:     number,
+		Dir:        filepath.Join(generationsDir(stateDir), strconv.Itoa(number)),
+		Created:    time.Now().UTC().Truncate(time.Second),
+		RollbackOf: rollbackOf,
+	}
+
+	// Write into a temporary directory first so that a crash cannot leave half a generation
+	tmpDir := generation.Dir + ".new"
+	if err := os.RemoveAll(tmpDir); err != nil {
+		return nil, fmt.Errorf("failed to remove %s: %v", tmpDir, err)
+	}
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create generation directory: %v", err)
+	}
+	if err := dist.save(tmpDir); err != nil {
+		return nil, err
+	}
+	if err := saveAppliedChanges(tmpDir, changes); err != nil {
+		return nil, err
+	}
+	if skipped != "" {
+		if err := copyStateFile(skipped, filepath.Join(tmpDir, skippedProfileFile)); err != nil {
+			return nil, err
+		}
+	}
+
+	data, err := json.MarshalIndent(generation, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode generation: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpDir, generationFile), append(data, '\n'), 0644); err != nil {
+		return nil, fmt.Errorf("failed to write generation: %v", err)
+	}
+
+	if err := os.Rename(tmpDir, generation.Dir); err != nil {
+		return nil, fmt.Errorf("failed to save generation: %v", err)
+	}
+
+	generations = append(generations, *generation)
+	if err := pruneGenerations(generations, history); err != nil {
+		return nil, err
+	}
+
+	return generation, nil
+}
+
+func pruneGenerations(generations []Generation, history int) error {
+	if history <= 0 {
+		history = defaultSyncHistory
+	}
+
+	for len(generations) > history {
+		if err := os.RemoveAll(generations[0].Dir); err != nil {
+			return fmt.Errorf("failed to remove generation %d: %v", generations[0].Number, err)
+		}
+		generations = generations[1:]
+	}
+
+	return nil
+}
+
+// The distribution's profile that a generation stands for. For a rollback, this is the profile
+// that was turned down rather than the one that was restored.
+func (g Generation) distProfilePath() string {
+	skipped := filepath.Join(g.Dir, skippedProfileFile)
+	if _, err := os.Stat(skipped); err == nil {
+		return skipped
+	}
+	return origProfilePath(g.Dir)
+}
+
+// Replace the profile stored in a generation by one setting the same properties
+func (g Generation) updateProfile(dist *DistProfile) error {
+	skipped := filepath.Join(g.Dir, skippedProfileFile)
+	if _, err := os.Stat(skipped); err == nil {
+		if err := os.WriteFile(skipped, dist.Data, 0644); err != nil {
+			return fmt.Errorf("failed to write %s: %v", skipped, err)
+		}
+		return nil
+	}
+	return dist.save(g.Dir)
+}
+
+// Print the generations of the state directory
+func printHistory() error {
+	generations, err := openSyncState(true)
+	if err != nil {
+		return err
+	}
+	if len(generations) == 0 {
+		fmt.Println("No profile has been synced yet")
+		return nil
+	}
+
+	for i, generation := range generations {
+		applied, _, err := loadStateProfile(filepath.Join(generation.Dir, appliedProfileFile))
+		if err != nil {
+			return err
+		}
+
+		count := 0
+		for _, properties := range applied.Properties.queries() {
+			count += len(properties)
+		}
+
+		changed := fmt.Sprintf("%d properties changed", count)
+		if count == 1 {
+			changed = "1 property changed"
+		}
+
+		notes := ""
+		if generation.RollbackOf != 0 {
+			notes += fmt.Sprintf(", rollback to %d", generation.RollbackOf)
+		}
+		if i == len(generations)-1 {
+			notes += " (current)"
+		}
+
+		fmt.Printf("%4d  %s  %s%s\n", generation.Number, generation.Created.Local().Format("2006-01-02 15:04:05"), changed, notes)
+	}
+
+	return nil
+}
+
+// Restore the settings of an earlier generation, or of the one before the current generation if
+// number is 0. The rollback is recorded as a new generation, and the distribution's profile it
+// turned down is not synced again until the distribution ships another one.
+func rollbackSync(backend Backend, number int, mergeBehavior MergeBehavior, exclude ExcludePatterns, history int, dryRun bool) error {
+	generations, err := openSyncState(dryRun)
+	if err != nil {
+		return err
+	}
+	if len(generations) == 0 {
+		return errors.New("no profile has been synced yet")
+	}
+	latest := generations[len(generations)-1]
+
+	var target *Generation
+	if number == 0 {
+		if len(generations) < 2 {
+			return errors.New("there is no earlier generation to roll back to")
+		}
+		target = &generations[len(generations)-2]
+	} else {
+		for i := range generations {
+			if generations[i].Number == number {
+				target = &generations[i]
+			}
+		}
+		if target == nil {
+			return fmt.Errorf("generation %d does not exist", number)
+		}
+		if target.Number == latest.Number {
+			return fmt.Errorf("generation %d is the current one", number)
+		}
+	}
+
+	if dryRun {
+		fmt.Println("Dry run -- the state directory is left unchanged")
+	}
+	fmt.Printf("Rolling back from generation %d to %d\n", latest.Number, target.Number)
+
+	// The user's overrides still win over the restored profile
+	targetProfile, err := loadGenerationProfile(target.Dir)
+	if err != nil {
+		return err
+	}
+	if err := targetProfile.addOverrides(getOverridesPath()); err != nil {
+		return err
+	}
+	changes, err := syncDelta(backend, latest.Dir, targetProfile.Profile, targetProfile.forced(), mergeBehavior, exclude, dryRun)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		return nil
+	}
+
+	_, err = saveGeneration(targetProfile, changes, target.Number, latest.distProfilePath(), history)
+	return err
+}
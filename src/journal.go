@@ -0,0 +1,179 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/fatih/color"
+)
+
+// AppliedChanges describes what applying a profile changed
+type AppliedChanges struct {
+	// Applied is a profile holding only the entries of the applied profile that changed properties
+	Applied *Profile
+	// Revert is a profile restoring every changed property to its state before the profile was
+	// applied. Properties that were not set are null, which resets them.
+	Revert *Profile
+}
+
+// Add the changes of a later run. Values applied later replace the ones applied before, while the
+// state recorded first is the one to go back to.
+func (c *AppliedChanges) add(later *AppliedChanges) {
+	for channel, properties := range later.Applied.Properties {
+		for property, value := range properties {
+			if c.Applied.Properties[channel] == nil {
+				c.Applied.Properties[channel] = make(map[string]any)
+			}
+			c.Applied.Properties[channel][property] = value
+		}
+	}
+	for channel, properties := range later.Revert.Properties {
+		for property, value := range properties {
+			c.Revert.addOnce(channel, property, value)
+		}
+	}
+}
+
+func newProfile() *Profile {
+	return &Profile{Properties: make(Properties)}
+}
+
+// Add a property to the profile unless it already has one, so that the first value recorded wins
+func (p *Profile) addOnce(channel string, property string, value any) {
+	if p.Properties[channel] == nil {
+		p.Properties[channel] = make(map[string]any)
+	}
+	if _, ok := p.Properties[channel][property]; !ok {
+		p.Properties[channel][property] = value
+	}
+}
+
+// Record the state of a property before changing it
+func (p *Profile) recordPrevious(channel string, property string, previous Value, wasSet bool) {
+	if wasSet {
+		p.addOnce(channel, property, previous.profileValue())
+	} else {
+		p.addOnce(channel, property, nil)
+	}
+}
+
+func saveProfile(profilePath string, profile *Profile) error {
+	data, err := json.MarshalIndent(profile, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode profile: %v", err)
+	}
+
+	if err := os.WriteFile(profilePath, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", profilePath, err)
+	}
+
+	return nil
+}
+
+// Add newly changed properties to a revert profile on disk. Properties already in it keep their
+// recorded state, which is the one from before the first time the profile was applied.
+func mergeRevertProfile(revertPath string, revert *Profile) error {
+	merged := newProfile()
+	if _, err := os.Stat(revertPath); err == nil {
+		existing, err := loadProfile(revertPath)
+		if err != nil {
+			return err
+		}
+		if existing.Properties != nil {
+			merged = existing
+		}
+	}
+
+	for channel, properties := range revert.Properties {
+		for property, value := range properties {
+			merged.addOnce(channel, property, value)
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(revertPath), 0755); err != nil {
+		return fmt.Errorf("failed to create state directory: %v", err)
+	}
+
+	return saveProfile(revertPath, merged)
+}
+
+// Where the revert profile of a profile applied with the apply command is kept. Each profile
+// applied to each target has its own.
+func revertProfilePath(profilePath string, target Target) (string, error) {
+	absPath, err := filepath.Abs(profilePath)
+	if err != nil {
+		return "", err
+	}
+
+	stateHome, err := stateHomeDir()
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256([]byte(absPath + "\n" + target.perchannelDir()))
+	return filepath.Join(stateHome, "applied", hex.EncodeToString(hash[:8])+".json"), nil
+}
+
+// Record the changes made by the apply command
+func saveRevertProfile(profilePath string, target Target, revert *Profile) error {
+	revertPath, err := revertProfilePath(profilePath, target)
+	if err != nil {
+		return err
+	}
+	return mergeRevertProfile(revertPath, revert)
+}
+
+// Apply a revert profile, setting properties back to their recorded value and resetting the ones
+// that were not set
+func restoreProfile(backend Backend, revert *Profile, dryRun bool) error {
+	blue := color.New(color.FgHiBlue).SprintFunc()
+	yellow := color.New(color.FgHiYellow).SprintFunc()
+
+	// A dry run changes an in-memory copy of the properties instead
+	dryRunNotice := ""
+	if dryRun {
+		backend = newPreviewBackend(backend)
+		dryRunNotice = " (skipping due to dry run)"
+	}
+
+	queries := revert.Properties.queries()
+	for _, channel := range slices.Sorted(maps.Keys(queries)) {
+		for _, property := range queries[channel] {
+			entry, err := parseProfileEntry(revert.Properties[channel][property], "")
+			if err != nil {
+				return fmt.Errorf("invalid recorded value for property %s%s: %v", channel, property, err)
+			}
+
+			if entry.Action == ActionSet {
+				fmt.Printf("%s Restoring %s%s ➔ %s%s\n", blue("•"), channel, property, entry.Value, dryRunNotice)
+				if err := backend.Set(channel, property, entry.Value); err != nil {
+					return err
+				}
+				continue
+			}
+
+			// xfconfd refuses to reset a property that does not exist
+			_, isSet, err := backend.Get(channel, property)
+			if err != nil {
+				return err
+			}
+			if !isSet {
+				fmt.Printf("%s Skipping unset property %s%s\n", yellow("•"), channel, property)
+				continue
+			}
+
+			fmt.Printf("%s Resetting %s%s%s\n", blue("•"), channel, property, dryRunNotice)
+			if err := backend.Reset(channel, property, false); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// StateLock is an advisory lock on the state directory. It keeps runs that change settings and
+// state, such as the sync started on login and one started by hand, from overlapping.
+type StateLock struct {
+	file *os.File
+}
+
+// Lock the state directory. Dry runs only read, so they share the lock with each other. Without
+// wait, this fails if another run holds the lock.
+func acquireStateLock(shared bool, wait bool) (*StateLock, error) {
+	stateHome, err := stateHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	lockPath := filepath.Join(stateHome, "lock")
+
+	var file *os.File
+	if shared {
+		// Dry runs leave the state directory untouched, so they do not create the lock file. If
+		// it does not exist, no run has changed anything yet and there is nothing to lock.
+		file, err = os.Open(lockPath)
+		if errors.Is(err, os.ErrNotExist) {
+			return &StateLock{}, nil
+		}
+	} else {
+		if err := os.MkdirAll(stateHome, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create state directory: %v", err)
+		}
+		file, err = os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0644)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", lockPath, err)
+	}
+
+	how := syscall.LOCK_EX
+	if shared {
+		how = syscall.LOCK_SH
+	}
+
+	err = syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		if !wait {
+			file.Close()
+			return nil, errors.New("another xfconf-profile is running, use --wait to wait for it to finish")
+		}
+		fmt.Println("Waiting for another xfconf-profile to finish")
+		err = syscall.Flock(int(file.Fd()), how)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to lock %s: %v", lockPath, err)
+	}
+
+	return &StateLock{file: file}, nil
+}
+
+// Release the lock. Closing the file releases it as well, which the kernel also does when the
+// process exits.
+func (l *StateLock) Release() error {
+	if l.file == nil {
+		return nil
+	}
+	return l.file.Close()
+}
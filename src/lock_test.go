@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func acquireTestLock(t *testing.T, shared bool) *StateLock {
+	t.Helper()
+	lock, err := acquireStateLock(shared, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { lock.Release() })
+	return lock
+}
+
+func TestStateLockConflicts(t *testing.T) {
+	tests := []struct {
+		name string
+		// Whether the lock held and the one asked for are the shared locks of dry runs
+		heldShared bool
+		shared     bool
+		wantErr    bool
+	}{
+		{name: "runs exclude each other", heldShared: false, shared: false, wantErr: true},
+		{name: "runs exclude dry runs", heldShared: false, shared: true, wantErr: true},
+		{name: "dry runs exclude runs", heldShared: true, shared: false, wantErr: true},
+		{name: "dry runs share the lock", heldShared: true, shared: true, wantErr: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("XDG_STATE_HOME", t.TempDir())
+			// Create the lock file, which dry runs do not
+			acquireTestLock(t, false).Release()
+
+			acquireTestLock(t, test.heldShared)
+			lock, err := acquireStateLock(test.shared, false)
+			if err == nil {
+				lock.Release()
+			}
+			if (err != nil) != test.wantErr {
+				t.Errorf("got error %v, want error %v", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestStateLockWait(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	held := acquireTestLock(t, false)
+
+	acquired := make(chan *StateLock)
+	go func() {
+		lock, err := acquireStateLock(false, true)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- lock
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("got the lock while it was held")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	held.Release()
+	select {
+	case lock := <-acquired:
+		lock.Release()
+	case <-time.After(5 * time.Second):
+		t.Fatal("did not get the lock after it was released")
+	}
+}
+
+func TestStateLockDryRunCreatesNothing(t *testing.T) {
+	stateHome := t.TempDir()
+	t.Setenv("XDG_STATE_HOME", stateHome)
+
+	lock := acquireTestLock(t, true)
+	if err := lock.Release(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(stateHome, "xfconf-profile")); !os.IsNotExist(err) {
+		t.Errorf("the dry run created the state directory")
+	}
+
+	// Once the lock file exists, dry runs lock it too
+	acquireTestLock(t, false).Release()
+	acquireTestLock(t, true)
+	if _, err := acquireStateLock(false, false); err == nil {
+		t.Error("got the lock while a dry run held it")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log/slog"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/spf13/cobra"
@@ -32,10 +33,47 @@ func chooseMergeBehavior(cfg *Config, flag string) MergeBehavior {
 	}
 }
 
+// Open the backend of the given kind or exit
+func chooseBackend(cfg *Config, kind string, target Target) Backend {
+	backend, err := openBackend(cfg, kind, target)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	return backend
+}
+
+func addWaitFlag(cmd *cobra.Command) {
+	cmd.Flags().Bool("wait", false, "Wait for another running xfconf-profile to finish instead of failing")
+}
+
+// Lock the state directory for the command or exit
+func lockState(cmd *cobra.Command, dryRun bool) *StateLock {
+	wait, _ := cmd.Flags().GetBool("wait")
+	lock, err := acquireStateLock(dryRun, wait)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	return lock
+}
+
+func addTargetFlags(cmd *cobra.Command) {
+	cmd.Flags().String("home", "", "Change the settings in this home directory instead of the current session")
+	cmd.Flags().String("root", "", "Change the settings in this system image, in /etc/skel unless --home is given")
+}
+
+func targetFromFlags(cmd *cobra.Command) Target {
+	home, _ := cmd.Flags().GetString("home")
+	root, _ := cmd.Flags().GetString("root")
+	return Target{Home: home, Root: root}
+}
+
 func createSyncCmd(cfg *Config) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "sync",
 		Short: "Sync user profile with distribution's recommended profile",
+		Args:  cobra.NoArgs,
 		Run: func(cmd *cobra.Command, args []string) {
 			auto, _ := cmd.Flags().GetBool("auto")
 			dryRun, _ := cmd.Flags().GetBool("dry-run")
@@ -49,16 +87,82 @@ func createSyncCmd(cfg *Config) *cobra.Command {
 			mergeBehavior := chooseMergeBehavior(cfg, mergeFlag)
 
 			distProfile, _ := cmd.Flags().GetString("profile")
-			if err := syncProfile(distProfile, mergeBehavior, cfg.Exclude, dryRun); err != nil {
+			lock := lockState(cmd, dryRun)
+			defer lock.Release()
+			backend := chooseBackend(cfg, BackendAuto, Target{})
+			defer backend.Close()
+
+			if err := syncProfile(backend, distProfile, mergeBehavior, cfg.Exclude, cfg.Sync.History, dryRun); err != nil {
 				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 				os.Exit(1)
 			}
 		},
 	}
-	cmd.Flags().StringP("profile", "p", "/usr/share/xfconf-profile/default.json", "Path to the distribution's recommended profile")
+	cmd.Flags().StringP("profile", "p", "/usr/share/xfconf-profile/default.json", "Path to the distribution's recommended profile, extended by the fragments in its .d directory")
 	cmd.Flags().StringP("merge", "m", "", "Set merge behavior (soft, hard, force)")
 	cmd.Flags().Bool("dry-run", false, "Only print what would be changed")
 	cmd.Flags().Bool("auto", false, "Flag indicating running as a user-level systemd unit by the distribution")
+	addWaitFlag(cmd)
+
+	cmd.AddCommand(createSyncHistoryCmd(), createSyncRollbackCmd(cfg))
+	return cmd
+}
+
+func createSyncHistoryCmd() *cobra.Command {
+	return &cobra.Command{
+		Use:   "history",
+		Short: "List the synced generations of the distribution's profile",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := printHistory(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+}
+
+func createSyncRollbackCmd(cfg *Config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "rollback [generation]",
+		Short: "Restore the settings of an earlier synced generation",
+		Long: `Restore the settings of an earlier synced generation
+
+      Without a generation, the one before the current generation is restored. The
+      rollback is recorded as a new generation, and the distribution's profile that
+      was rolled back from is not synced again until the distribution ships a new one.
+      Properties changed by the user since they were synced are left alone.`,
+		Args: cobra.MaximumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+			number := 0
+			if len(args) == 1 {
+				parsed, err := strconv.Atoi(args[0])
+				if err != nil || parsed <= 0 {
+					fmt.Fprintf(os.Stderr, "Error: invalid generation: %s\n", args[0])
+					os.Exit(1)
+				}
+				number = parsed
+			}
+
+			mergeFlag, _ := cmd.Flags().GetString("merge")
+			mergeBehavior := chooseMergeBehavior(cfg, mergeFlag)
+
+			lock := lockState(cmd, dryRun)
+			defer lock.Release()
+			backend := chooseBackend(cfg, BackendAuto, Target{})
+			defer backend.Close()
+
+			if err := rollbackSync(backend, number, mergeBehavior, cfg.Exclude, cfg.Sync.History, dryRun); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+	cmd.Flags().StringP("merge", "m", "", "Set merge behavior (soft, hard, force)")
+	cmd.Flags().Bool("dry-run", false, "Only print what would be changed")
+	addWaitFlag(cmd)
 
 	return cmd
 }
@@ -74,7 +178,17 @@ func createApplyCmd(cfg *Config) *cobra.Command {
 			mergeFlag, _ := cmd.Flags().GetString("merge")
 			mergeBehavior := chooseMergeBehavior(cfg, mergeFlag)
 
-			err := applyProfile(args[0], mergeBehavior, cfg.Exclude, dryRun)
+			backendFlag, _ := cmd.Flags().GetString("backend")
+			target := targetFromFlags(cmd)
+			lock := lockState(cmd, dryRun)
+			defer lock.Release()
+			backend := chooseBackend(cfg, backendFlag, target)
+			defer backend.Close()
+
+			changes, err := applyProfile(backend, args[0], mergeBehavior, cfg.Exclude, dryRun)
+			if err == nil && !dryRun {
+				err = saveRevertProfile(args[0], target, changes.Revert)
+			}
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 				os.Exit(1)
@@ -84,6 +198,9 @@ func createApplyCmd(cfg *Config) *cobra.Command {
 
 	cmd.Flags().StringP("merge", "m", "soft", "Set merge behavior (soft, hard, force)")
 	cmd.Flags().Bool("dry-run", false, "Only print what would be changed")
+	cmd.Flags().String("backend", BackendAuto, "Where to change settings (auto, dbus, xfconf-query, xml)")
+	addTargetFlags(cmd)
+	addWaitFlag(cmd)
 	return cmd
 }
 
@@ -95,7 +212,17 @@ func createRevertCmd(cfg *Config) *cobra.Command {
 		Run: func(cmd *cobra.Command, args []string) {
 			dryRun, _ := cmd.Flags().GetBool("dry-run")
 
-			err := revertProfile(args[0], cfg.Exclude, dryRun)
+			backendFlag, _ := cmd.Flags().GetString("backend")
+			target := targetFromFlags(cmd)
+			lock := lockState(cmd, dryRun)
+			defer lock.Release()
+			backend := chooseBackend(cfg, backendFlag, target)
+			defer backend.Close()
+
+			revertPath, err := revertProfilePath(args[0], target)
+			if err == nil {
+				err = revertProfile(backend, args[0], revertPath, cfg.Exclude, dryRun)
+			}
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 				os.Exit(1)
@@ -104,15 +231,44 @@ func createRevertCmd(cfg *Config) *cobra.Command {
 	}
 
 	cmd.Flags().Bool("dry-run", false, "Only print what would be changed")
+	cmd.Flags().String("backend", BackendAuto, "Where to change settings (auto, dbus, xfconf-query, xml)")
+	addTargetFlags(cmd)
+	addWaitFlag(cmd)
 	return cmd
 }
 
-var recordCmd = &cobra.Command{
-	Use:   "record",
-	Short: "Record changes to xfconf properties and dump them as a profile",
-	Run: func(cmd *cobra.Command, args []string) {
-		recordProfile()
-	},
+func createBuildDefaultsCmd() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "build-defaults [path]",
+		Short: "Merge a profile into the vendor's default settings for distribution packaging",
+		Long: `Merge a profile into the vendor's default settings for distribution packaging
+
+      Every channel changed by the profile is read from the vendor's perchannel XML
+      directory, changed according to the profile and written to the output directory.
+      The output can then be shipped as system-wide defaults in place of the vendor's
+      files. Without --vendor-dir, each channel is read from the first directory of
+      $XDG_CONFIG_DIRS that has it, /etc/xdg and then /usr/etc/xdg by default.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			vendorDir, _ := cmd.Flags().GetString("vendor-dir")
+			outputDir, _ := cmd.Flags().GetString("output")
+
+			vendorDirs := systemPerchannelDirs()
+			if vendorDir != "" {
+				vendorDirs = []string{vendorDir}
+			}
+
+			if err := buildDefaults(args[0], vendorDirs, outputDir); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	cmd.Flags().String("vendor-dir", "", "Directory of the vendor's perchannel XML files (default: searched in $XDG_CONFIG_DIRS)")
+	cmd.Flags().StringP("output", "o", "", "Directory to write the merged perchannel XML files to")
+	cmd.MarkFlagRequired("output")
+	return cmd
 }
 
 var versionCmd = &cobra.Command{
@@ -125,17 +281,70 @@ var versionCmd = &cobra.Command{
 	},
 }
 
-func createGetDefaultCmd() *cobra.Command {
+func createRecordCmd(cfg *Config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "record",
+		Short: "Record changes to xfconf properties and dump them as a profile",
+		Long: `Record changes to xfconf properties and dump them as a profile
+
+      Changes are printed as xfconf-query commands as they happen. With
+      "--format profile", they are collected into a profile instead, which is
+      written when recording is stopped with Ctrl-C.
+
+      Changes are seen through xfconfd's D-Bus signals as they happen if xfconfd
+      can be reached, and through its XML files otherwise. xfconfd writes these
+      files lazily, so changes may show up late with "--backend xml".
+
+      Properties matching the exclude patterns of the config are not recorded.
+      Like these, --include and --exclude are regular expressions on the fully
+      qualified name of the property, such as "xfwm4/general/theme".`,
+		Args: cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			format, _ := cmd.Flags().GetString("format")
+			output, _ := cmd.Flags().GetString("output")
+			name, _ := cmd.Flags().GetString("name")
+			profileVersion, _ := cmd.Flags().GetString("version")
+			backend, _ := cmd.Flags().GetString("backend")
+			channels, _ := cmd.Flags().GetStringSlice("channel")
+			include, _ := cmd.Flags().GetStringArray("include")
+			exclude, _ := cmd.Flags().GetStringArray("exclude")
+			duration, _ := cmd.Flags().GetDuration("duration")
+
+			filter, err := newRecordFilter(channels, include, exclude, cfg.Exclude)
+			if err == nil {
+				err = recordProfile(backend, filter, duration, format, output, name, profileVersion)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+		},
+	}
+
+	cmd.Flags().StringP("format", "f", RecordFormatCommands, "Output format (commands, profile)")
+	cmd.Flags().StringP("output", "o", "", "File to write the recorded profile to instead of printing it")
+	cmd.Flags().String("name", "", "Name to put in the recorded profile's metadata")
+	cmd.Flags().String("version", "", "Version to put in the recorded profile's metadata")
+	cmd.Flags().String("backend", BackendAuto, "Where to watch settings (auto, dbus, xml)")
+	cmd.Flags().StringSliceP("channel", "c", nil, "Only record changes to these channels")
+	cmd.Flags().StringArray("include", nil, "Only record properties matching this regular expression (can be repeated)")
+	cmd.Flags().StringArray("exclude", nil, "Do not record properties matching this regular expression (can be repeated)")
+	cmd.Flags().Duration("duration", 0, "Stop recording after this long, such as 60s")
+	return cmd
+}
+
+func createGetDefaultCmd(cfg *Config) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "get-default <channel> <property>",
-		Short: "Query xfconfd for the default value of a given property",
-		Long: `Query xfconfd for the default value of a given property
+		Short: "Print the default value of a given property",
+		Long: `Print the default value of a given property
 
       If the property does not exist, the command will return nothing on stdout and
       exit with code 127.
 
-      Default values are found using xfconf-query on the distribution's provided Xfce settings,
-      either found in /usr/etc/xdg or /etc/xdg.`,
+      Default values are read from the distribution's provided Xfce settings in each
+      directory of $XDG_CONFIG_DIRS (/etc/xdg and /usr/etc/xdg if unset). With
+      "defaults: xfconfd" in the config, a throwaway xfconfd is queried instead.`,
 		Args: cobra.ExactArgs(2),
 		Run: func(cmd *cobra.Command, args []string) {
 			channel := args[0]
@@ -145,15 +354,15 @@ func createGetDefaultCmd() *cobra.Command {
 				channel: {property},
 			}
 
-			defaultValues, err := gatherDefaultPropertyValues(query)
+			defaultValues, err := systemDefaults(cfg.Defaults).Defaults(query)
 			if err != nil {
 				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
 				os.Exit(1)
 			}
 
-			defaultValue := defaultValues[channel][property]
-			if defaultValue != "" {
-				fmt.Println(defaultValue)
+			defaultValue, ok := defaultValues[channel][property]
+			if ok {
+				fmt.Println(defaultValue.queryOutput())
 			} else {
 				os.Exit(127)
 			}
@@ -188,15 +397,8 @@ func initLogger() {
 	logger = slog.New(handler)
 }
 
-func main() {
-	initLogger()
-
-	config, err := loadConfig()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
-		os.Exit(1)
-	}
-
+// The xfconf-profile command and its subcommands
+func createRootCmd(config *Config) *cobra.Command {
 	var rootCmd = &cobra.Command{
 		Use:   "xfconf-profile",
 		Short: "Tool for applying, reverting and managing Xfce profiles",
@@ -205,16 +407,31 @@ func main() {
 	applyCmd := createApplyCmd(config)
 	revertCmd := createRevertCmd(config)
 	syncCmd := createSyncCmd(config)
-	getDefaultCmd := createGetDefaultCmd()
+	getDefaultCmd := createGetDefaultCmd(config)
+	buildDefaultsCmd := createBuildDefaultsCmd()
+	recordCmd := createRecordCmd(config)
 
 	rootCmd.AddGroup(&cobra.Group{ID: "profile", Title: "Profile Management"})
 	applyCmd.GroupID = "profile"
 	revertCmd.GroupID = "profile"
 	syncCmd.GroupID = "profile"
 	recordCmd.GroupID = "profile"
-	rootCmd.AddCommand(applyCmd, revertCmd, syncCmd, getDefaultCmd, versionCmd, recordCmd)
+	buildDefaultsCmd.GroupID = "profile"
+	rootCmd.AddCommand(applyCmd, revertCmd, syncCmd, getDefaultCmd, versionCmd, recordCmd, buildDefaultsCmd)
+
+	return rootCmd
+}
+
+func main() {
+	initLogger()
+
+	config, err := loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		os.Exit(1)
+	}
 
-	if err := rootCmd.Execute(); err != nil {
+	if err := createRootCmd(config).Execute(); err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
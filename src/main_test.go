@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	initLogger()
+	os.Exit(m.Run())
+}
+
+// Run the command line with the given arguments, and return the error cobra reports for them
+func executeCommand(t *testing.T, args ...string) error {
+	t.Helper()
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+
+	config, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := createRootCmd(config)
+	cmd.SetArgs(args)
+	cmd.SetOut(io.Discard)
+	cmd.SetErr(io.Discard)
+	return cmd.Execute()
+}
+
+func TestUnknownArguments(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{args: []string{"sync", "histroy"}, want: `unknown command "histroy" for "xfconf-profile sync"`},
+		{args: []string{"sync", "history", "extra"}, want: `unknown command "extra" for "xfconf-profile sync history"`},
+		{args: []string{"sync", "rollback", "1", "2"}, want: "accepts at most 1 arg(s), received 2"},
+	}
+
+	for _, test := range tests {
+		t.Run(strings.Join(test.args, " "), func(t *testing.T) {
+			err := executeCommand(t, test.args...)
+			if err == nil || err.Error() != test.want {
+				t.Errorf("got error %v, want %s", err, test.want)
+			}
+		})
+	}
+}
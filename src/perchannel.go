@@ -0,0 +1,422 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// The directory holding the perchannel XML files of a config directory such as /etc/xdg
+func perchannelDir(configDir string) string {
+	return filepath.Join(configDir, "xfce4", "xfconf", "xfce-perchannel-xml")
+}
+
+// Channel is the tree of properties stored in a perchannel XML file
+type Channel struct {
+	XMLName  xml.Name   `xml:"channel"`
+	Name     string     `xml:"name,attr"`
+	Version  string     `xml:"version,attr"`
+	Property []Property `xml:"property"`
+
+	// Comments before the channel, such as the license header of a vendor's file. Comments
+	// inside the channel are not kept, like xfconfd does not keep them either.
+	Header []string `xml:"-"`
+}
+
+func readChannel(xmlFile string) (*Channel, error) {
+	data, err := os.ReadFile(xmlFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var channel Channel
+	if err := xml.Unmarshal(data, &channel); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", xmlFile, err)
+	}
+	channel.Header = readHeader(data)
+
+	return &channel, nil
+}
+
+// The comments in front of the channel element, which unmarshalling leaves out
+func readHeader(data []byte) []string {
+	var header []string
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	for {
+		token, err := decoder.Token()
+		if err != nil {
+			return header
+		}
+		switch t := token.(type) {
+		case xml.Comment:
+			header = append(header, string(t))
+		case xml.StartElement:
+			return header
+		}
+	}
+}
+
+// Write the channel in the same format as xfconfd. The file is replaced atomically so that a
+// crash cannot leave a truncated channel behind.
+func (c *Channel) write(xmlFile string) error {
+	if err := os.MkdirAll(filepath.Dir(xmlFile), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", filepath.Dir(xmlFile), err)
+	}
+
+	tmpFile := xmlFile + ".new"
+	if err := os.WriteFile(tmpFile, []byte(c.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", tmpFile, err)
+	}
+	if err := os.Rename(tmpFile, xmlFile); err != nil {
+		return fmt.Errorf("failed to replace %s: %v", xmlFile, err)
+	}
+
+	return nil
+}
+
+// String serializes the channel to the perchannel XML format
+func (c *Channel) String() string {
+	version := c.Version
+	if version == "" {
+		version = "1.0"
+	}
+
+	var b strings.Builder
+	b.WriteString("<?xml version=\"1.0\" encoding=\"UTF-8\"?>\n\n")
+	for _, comment := range c.Header {
+		fmt.Fprintf(&b, "<!--%s-->\n", comment)
+	}
+	if len(c.Header) > 0 {
+		b.WriteString("\n")
+	}
+	fmt.Fprintf(&b, "<channel name=\"%s\" version=\"%s\">\n", escapeAttr(c.Name), escapeAttr(version))
+	for _, prop := range c.Property {
+		writeProperty(&b, prop, 1)
+	}
+	b.WriteString("</channel>\n")
+
+	return b.String()
+}
+
+func writeProperty(b *strings.Builder, prop Property, depth int) {
+	indent := strings.Repeat("  ", depth)
+
+	fmt.Fprintf(b, "%s<property name=\"%s\" type=\"%s\"", indent, escapeAttr(prop.Name), escapeAttr(prop.Type))
+	if prop.Type != "empty" && prop.Type != "array" {
+		fmt.Fprintf(b, " value=\"%s\"", escapeAttr(prop.Value))
+	}
+	if prop.Locked != "" {
+		fmt.Fprintf(b, " locked=\"%s\"", escapeAttr(prop.Locked))
+	}
+
+	if len(prop.Values) == 0 && len(prop.Property) == 0 {
+		b.WriteString("/>\n")
+		return
+	}
+
+	b.WriteString(">\n")
+	for _, item := range prop.Values {
+		fmt.Fprintf(b, "%s  <value type=\"%s\" value=\"%s\"/>\n", indent, escapeAttr(item.Type), escapeAttr(item.Value))
+	}
+	for _, subProp := range prop.Property {
+		writeProperty(b, subProp, depth+1)
+	}
+	fmt.Fprintf(b, "%s</property>\n", indent)
+}
+
+var attrEscaper = strings.NewReplacer(
+	"&", "&amp;",
+	"<", "&lt;",
+	">", "&gt;",
+	"\"", "&quot;",
+	"'", "&apos;",
+	"\n", "&#10;",
+	"\r", "&#13;",
+	"\t", "&#9;",
+)
+
+func escapeAttr(value string) string {
+	return attrEscaper.Replace(value)
+}
+
+func splitPropertyPath(property string) []string {
+	return strings.Split(strings.Trim(property, "/"), "/")
+}
+
+func findProperty(props []Property, name string) *Property {
+	for i := range props {
+		if props[i].Name == name {
+			return &props[i]
+		}
+	}
+	return nil
+}
+
+// Find a property in the channel's tree, or nil if it does not exist
+func (c *Channel) lookup(property string) *Property {
+	props := c.Property
+	var node *Property
+
+	for _, name := range splitPropertyPath(property) {
+		node = findProperty(props, name)
+		if node == nil {
+			return nil
+		}
+		props = node.Property
+	}
+
+	return node
+}
+
+// Set a property, creating its parents as needed. Child properties are kept.
+func (c *Channel) set(property string, value Value) {
+	props := &c.Property
+	var node *Property
+
+	for _, name := range splitPropertyPath(property) {
+		node = findProperty(*props, name)
+		if node == nil {
+			*props = append(*props, Property{Name: name, Type: "empty"})
+			node = &(*props)[len(*props)-1]
+		}
+		props = &node.Property
+	}
+
+	node.Type = value.Type
+	node.Value = ""
+	node.Values = nil
+	if value.Type == "array" {
+		for _, item := range value.Items {
+			node.Values = append(node.Values, Property{Type: item.Type, Value: item.Value})
+		}
+	} else {
+		node.Value = value.Value
+	}
+}
+
+// Remove the value of a property. With recursive, its child properties are removed as well.
+func (c *Channel) reset(property string, recursive bool) {
+	if strings.Trim(property, "/") == "" {
+		if recursive {
+			c.Property = nil
+		}
+		return
+	}
+
+	c.Property = resetProperties(c.Property, splitPropertyPath(property), recursive)
+}
+
+func resetProperties(props []Property, names []string, recursive bool) []Property {
+	for i := range props {
+		if props[i].Name != names[0] {
+			continue
+		}
+
+		if len(names) > 1 {
+			props[i].Property = resetProperties(props[i].Property, names[1:], recursive)
+		} else {
+			props[i].Type = "empty"
+			props[i].Value = ""
+			props[i].Values = nil
+			if recursive {
+				props[i].Property = nil
+			}
+		}
+
+		// Like xfconfd, drop properties left with neither a value nor children
+		if props[i].Type == "empty" && len(props[i].Property) == 0 {
+			return append(props[:i], props[i+1:]...)
+		}
+		return props
+	}
+
+	return props
+}
+
+// Convert a property of the tree to a typed value. Returns false for properties that only group
+// other properties.
+func (p *Property) toValue() (Value, bool) {
+	switch p.Type {
+	case "empty", "":
+		return Value{}, false
+	case "array":
+		array := Value{Type: "array", Items: []Value{}}
+		for _, item := range p.Values {
+			array.Items = append(array.Items, Value{Type: item.Type, Value: item.Value})
+		}
+		return array, true
+	default:
+		return Value{Type: p.Type, Value: p.Value}, true
+	}
+}
+
+// Collect every property with a value below the given path
+func collectValues(props []Property, path string, values map[string]Value) {
+	for i := range props {
+		propertyPath := path + "/" + props[i].Name
+		if value, ok := props[i].toValue(); ok {
+			values[propertyPath] = value
+		}
+		collectValues(props[i].Property, propertyPath, values)
+	}
+}
+
+// XfconfXML reads and writes properties straight in a directory of perchannel XML files, such as
+// ~/.config/xfce4/xfconf/xfce-perchannel-xml. It does not need xfconfd or a session bus, which
+// allows preparing settings offline. xfconfd should not be running for the same directory since
+// it would overwrite the changes with its own copy of the settings.
+//
+// Only the properties stored in the directory are visible. Defaults from the system config
+// directories do not show through like they do with xfconfd.
+type XfconfXML struct {
+	DefaultsSource
+
+	dir      string
+	channels map[string]*Channel
+	// Who gets the files and directories written, if not the user running the command
+	owner *fileOwner
+}
+
+// fileOwner is the user and group owning a file
+type fileOwner struct {
+	uid int
+	gid int
+}
+
+// The owner of an existing file
+func ownerOf(path string) (*fileOwner, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil, fmt.Errorf("cannot tell the owner of %s", path)
+	}
+	return &fileOwner{uid: int(stat.Uid), gid: int(stat.Gid)}, nil
+}
+
+func NewXfconfXML(dir string, defaults DefaultsSource) *XfconfXML {
+	return &XfconfXML{
+		DefaultsSource: defaults,
+		dir:            dir,
+		channels:       make(map[string]*Channel),
+	}
+}
+
+func (x *XfconfXML) channelPath(channel string) string {
+	return filepath.Join(x.dir, channel+".xml")
+}
+
+// Load a channel from its file, or start an empty one if it does not exist yet
+func (x *XfconfXML) channel(name string) (*Channel, error) {
+	if channel, ok := x.channels[name]; ok {
+		return channel, nil
+	}
+
+	channel, err := readChannel(x.channelPath(name))
+	if errors.Is(err, os.ErrNotExist) {
+		channel = &Channel{Name: name, Version: "1.0"}
+	} else if err != nil {
+		return nil, err
+	}
+
+	x.channels[name] = channel
+	return channel, nil
+}
+
+// Write a channel to its file. With an owner, the file and the directories created for it are
+// given to the owner, so that a home's xfconfd can still save its settings after root changed them.
+func (x *XfconfXML) write(channel string, c *Channel) error {
+	path := x.channelPath(channel)
+
+	var created []string
+	if x.owner != nil {
+		for dir := x.dir; ; dir = filepath.Dir(dir) {
+			if _, err := os.Stat(dir); err == nil || dir == filepath.Dir(dir) {
+				break
+			}
+			created = append(created, dir)
+		}
+	}
+
+	if err := c.write(path); err != nil {
+		return err
+	}
+	if x.owner == nil {
+		return nil
+	}
+
+	for _, name := range append(created, path) {
+		if err := os.Lchown(name, x.owner.uid, x.owner.gid); err != nil {
+			return fmt.Errorf("failed to change the owner of %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+func (x *XfconfXML) Get(channel, property string) (Value, bool, error) {
+	c, err := x.channel(channel)
+	if err != nil {
+		return Value{}, false, err
+	}
+
+	node := c.lookup(property)
+	if node == nil {
+		return Value{}, false, nil
+	}
+
+	value, ok := node.toValue()
+	return value, ok, nil
+}
+
+func (x *XfconfXML) List(channel string) (map[string]Value, error) {
+	c, err := x.channel(channel)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make(map[string]Value)
+	collectValues(c.Property, "", values)
+	return values, nil
+}
+
+func (x *XfconfXML) Set(channel, property string, value Value) error {
+	if value.Type != "array" {
+		if err := validateScalar(value.Type, value.Value); err != nil {
+			return fmt.Errorf("cannot set %s%s: %v", channel, property, err)
+		}
+	}
+
+	c, err := x.channel(channel)
+	if err != nil {
+		return err
+	}
+
+	c.set(property, value)
+	return x.write(channel, c)
+}
+
+func (x *XfconfXML) Reset(channel, property string, recursive bool) error {
+	c, err := x.channel(channel)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(x.channelPath(channel)); errors.Is(err, os.ErrNotExist) {
+		// Nothing to reset in a channel that was never written
+		return nil
+	}
+
+	c.reset(property, recursive)
+	return x.write(channel, c)
+}
+
+func (x *XfconfXML) Close() error {
+	return nil
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// A channel as xfconfd writes it, with the license header vendors put in front of it
+const xfwm4Channel = `<?xml version="1.0" encoding="UTF-8"?>
+
+<!-- SPDX-License-Identifier: GPL-2.0-or-later -->
+
+<channel name="xfwm4" version="1.0">
+  <property name="general" type="empty">
+    <property name="theme" type="string" value="Chicago95"/>
+    <property name="title_font" type="string" value="Sans Bold &amp; &quot;Italic&quot; 9" locked="*"/>
+    <property name="workspace_names" type="array">
+      <value type="string" value="One"/>
+      <value type="string" value="Two"/>
+    </property>
+    <property name="snap" type="bool" value="true">
+      <property name="width" type="int" value="10"/>
+    </property>
+  </property>
+</channel>
+`
+
+func TestChannelRoundTrip(t *testing.T) {
+	path := writeTestFile(t, filepath.Join(t.TempDir(), "xfwm4.xml"), xfwm4Channel)
+
+	channel, err := readChannel(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := channel.String(); got != xfwm4Channel {
+		t.Errorf("serialized as\n%s\nwant\n%s", got, xfwm4Channel)
+	}
+
+	values := make(map[string]Value)
+	collectValues(channel.Property, "", values)
+	want := testValues{
+		"xfwm4/general/theme":      str("Chicago95"),
+		"xfwm4/general/title_font": str(`Sans Bold & "Italic" 9`),
+		"xfwm4/general/workspace_names": {Type: "array", Items: []Value{
+			{Type: "string", Value: "One"},
+			{Type: "string", Value: "Two"},
+		}},
+		"xfwm4/general/snap":       {Type: "bool", Value: "true"},
+		"xfwm4/general/snap/width": {Type: "int", Value: "10"},
+	}
+	backend := NewMemoryBackend()
+	backend.Properties = map[string]map[string]Value{"xfwm4": values}
+	assertProperties(t, backend, want)
+}
+
+func TestChannelSetAndReset(t *testing.T) {
+	channel := &Channel{Name: "xfce4-panel", Version: "1.0"}
+
+	channel.set("/plugins/plugin-1", str("clock"))
+	channel.set("/plugins/plugin-1/digital-format", str("%R"))
+	channel.set("/panels", Value{Type: "array", Items: []Value{{Type: "int", Value: "1"}}})
+	want := `<?xml version="1.0" encoding="UTF-8"?>
+
+<channel name="xfce4-panel" version="1.0">
+  <property name="plugins" type="empty">
+    <property name="plugin-1" type="string" value="clock">
+      <property name="digital-format" type="string" value="%R"/>
+    </property>
+  </property>
+  <property name="panels" type="array">
+    <value type="int" value="1"/>
+  </property>
+</channel>
+`
+	if got := channel.String(); got != want {
+		t.Errorf("after setting, serialized as\n%s\nwant\n%s", got, want)
+	}
+
+	// A property keeps its children when reset, unless the reset is recursive
+	channel.reset("/plugins/plugin-1", false)
+	if channel.lookup("/plugins/plugin-1/digital-format") == nil {
+		t.Error("resetting /plugins/plugin-1 removed its children")
+	}
+	if node := channel.lookup("/plugins/plugin-1"); node == nil || node.Type != "empty" {
+		t.Errorf("/plugins/plugin-1 is %+v after its reset, want an empty property", node)
+	}
+
+	// Properties left with neither a value nor children are dropped, like xfconfd does
+	channel.reset("/plugins/plugin-1/digital-format", false)
+	channel.reset("/panels", true)
+	want = `<?xml version="1.0" encoding="UTF-8"?>
+
+<channel name="xfce4-panel" version="1.0">
+</channel>
+`
+	if got := channel.String(); got != want {
+		t.Errorf("after resetting, serialized as\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestXfconfXML(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "xfwm4.xml"), xfwm4Channel)
+	backend := NewXfconfXML(dir, nil)
+
+	if value, ok, err := backend.Get("xfwm4", "/general/theme"); err != nil || !ok || !value.Equal(str("Chicago95")) {
+		t.Errorf("Get(/general/theme) = %v, %v, %v", value, ok, err)
+	}
+	if _, ok, err := backend.Get("xfwm4", "/general"); err != nil || ok {
+		t.Errorf("Get(/general) = %v, %v, want a property without a value", ok, err)
+	}
+
+	if err := backend.Set("xfwm4", "/general/workspace_count", Value{Type: "int", Value: "many"}); err == nil {
+		t.Error("Set accepted an invalid int")
+	}
+	if err := backend.Set("xfwm4", "/general/workspace_count", Value{Type: "int", Value: "4"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.Reset("xfwm4", "/general/snap", true); err != nil {
+		t.Fatal(err)
+	}
+
+	// The changes are written right away, and the rest of the file is kept
+	assertChannel(t, dir, "xfwm4", testValues{
+		"xfwm4/general/theme":      str("Chicago95"),
+		"xfwm4/general/title_font": str(`Sans Bold & "Italic" 9`),
+		"xfwm4/general/workspace_names": {Type: "array", Items: []Value{
+			{Type: "string", Value: "One"},
+			{Type: "string", Value: "Two"},
+		}},
+		"xfwm4/general/workspace_count": {Type: "int", Value: "4"},
+	})
+	data, err := os.ReadFile(filepath.Join(dir, "xfwm4.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), "<!-- SPDX-License-Identifier: GPL-2.0-or-later -->") ||
+		!strings.Contains(string(data), `locked="*"`) {
+		t.Errorf("the header or lock was dropped:\n%s", data)
+	}
+
+	// Resetting in a channel that was never written leaves no file behind
+	if err := backend.Reset("thunar", "/last-view", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "thunar.xml")); !os.IsNotExist(err) {
+		t.Error("resetting a property created thunar.xml")
+	}
+}
+
+func TestXfconfXMLOwner(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("changing the owner of files needs root")
+	}
+
+	home := t.TempDir()
+	dir := perchannelDir(filepath.Join(home, ".config"))
+	backend := NewXfconfXML(dir, nil)
+	backend.owner = &fileOwner{uid: 1234, gid: 1234}
+
+	if err := backend.Set("xfwm4", "/general/theme", str("Chicago95")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything created for the file is given away, and the home itself is left alone
+	for path := dir; path != home; path = filepath.Dir(path) {
+		assertOwner(t, path, 1234)
+	}
+	assertOwner(t, filepath.Join(dir, "xfwm4.xml"), 1234)
+	assertOwner(t, home, 0)
+}
+
+func assertOwner(t *testing.T, path string, uid int) {
+	t.Helper()
+
+	info, err := os.Lstat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := int(info.Sys().(*syscall.Stat_t).Uid); got != uid {
+		t.Errorf("%s is owned by %d, want %d", path, got, uid)
+	}
+}
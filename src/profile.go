@@ -1,12 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"maps"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"slices"
 	"strings"
 
 	"github.com/fatih/color"
@@ -14,60 +15,101 @@ import (
 
 type Properties map[string]map[string]any
 
+// The properties of each channel in sorted order, so that parents come before their children
+func (p Properties) queries() map[string][]string {
+	queries := make(map[string][]string)
+	for channel, properties := range p {
+		// Keys starting with X- are not channels
+		if strings.HasPrefix(channel, "X-") {
+			continue
+		}
+
+		queries[channel] = slices.Sorted(maps.Keys(properties))
+	}
+	return queries
+}
+
 type Profile struct {
-	Properties Properties `json:"properties"`
+	Properties Properties     `json:"properties"`
+	Metadata   map[string]any `json:"metadata,omitempty"`
 }
 
-// TODO: return a new profile that only includes properties that were actually changed based on the merge and exclude settings.
-func applyProfile(profilePath string, mergeBehavior MergeBehavior, exclude ExcludePatterns, dryRun bool) error {
+// Read a profile from disk. Numbers are kept as json.Number so that their xfconf type can be
+// decided once we know the type of the property they are applied to.
+func loadProfile(profilePath string) (*Profile, error) {
 	data, err := os.ReadFile(profilePath)
 	if err != nil {
-		return fmt.Errorf("failed to read file: %v", err)
+		return nil, fmt.Errorf("failed to read file: %v", err)
 	}
 
 	var profile Profile
-	err = json.Unmarshal(data, &profile)
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&profile); err != nil {
+		return nil, fmt.Errorf("failed to parse JSON: %v", err)
+	}
+
+	return &profile, nil
+}
+
+// Apply a profile, skipping properties based on the merge behavior and exclude patterns. The
+// returned changes hold only the properties that were actually changed.
+func applyProfile(backend Backend, profilePath string, mergeBehavior MergeBehavior, exclude ExcludePatterns, dryRun bool) (*AppliedChanges, error) {
+	profile, err := loadProfile(profilePath)
 	if err != nil {
-		return fmt.Errorf("failed to parse JSON: %v", err)
+		return nil, err
 	}
 
+	return applyProperties(backend, profile, mergeBehavior, exclude, dryRun)
+}
+
+func applyProperties(backend Backend, profile *Profile, mergeBehavior MergeBehavior, exclude ExcludePatterns, dryRun bool) (*AppliedChanges, error) {
 	blue := color.New(color.FgHiBlue).SprintFunc()
 	yellow := color.New(color.FgHiYellow).SprintFunc()
 
-	// Get all the default values
-	defaultValueQueries := make(map[string][]string)
-	for channel, properties := range profile.Properties {
-		defaultValueQueries[channel] = []string{}
-		for property, _ := range properties {
-			defaultValueQueries[channel] = append(defaultValueQueries[channel], property)
-		}
+	// A dry run changes an in-memory copy of the properties instead
+	if dryRun {
+		backend = newPreviewBackend(backend)
 	}
 
-	defaultValues, err := gatherDefaultPropertyValues(defaultValueQueries)
+	// Get all the default values
+	defaultValueQueries := profile.Properties.queries()
+
+	defaultValues, err := backend.Defaults(defaultValueQueries)
 	if err != nil {
-		return fmt.Errorf("could not get default property values: %v", err)
+		return nil, fmt.Errorf("could not get default property values: %v", err)
 	}
 
-	currentValues, err := gatherCurrentPropertyValues(defaultValueQueries)
+	currentValues, err := gatherCurrentValues(backend, defaultValueQueries)
 	if err != nil {
-		return fmt.Errorf("could not get current property values: %v", err)
+		return nil, fmt.Errorf("could not get current property values: %v", err)
 	}
 
-	for channel, properties := range profile.Properties {
-		// Keys starting with X- are not channels
-		if strings.HasPrefix(channel, "X-") {
-			continue
-		}
+	changes := &AppliedChanges{Applied: newProfile(), Revert: newProfile()}
 
-		for property, value := range properties {
-			// Check if this property should be skipped based on merge preferences
-			if mergeBehavior == MergeSoft {
-				defaultValue := defaultValues[channel][property]
-				currentValue := currentValues[channel][property]
+	for _, channel := range slices.Sorted(maps.Keys(defaultValueQueries)) {
+		for _, property := range defaultValueQueries[channel] {
+			rawValue := profile.Properties[channel][property]
+			defaultValue, hasDefault := defaultValues[channel][property]
+			currentValue, hasCurrent := currentValues[channel][property]
 
+			// Numbers take the type of the current value, or of the default if there is none
+			typeHint := defaultValue.typeHint()
+			if hasCurrent && currentValue.typeHint() != "" {
+				typeHint = currentValue.typeHint()
+			}
+
+			entry, err := parseProfileEntry(rawValue, typeHint)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value for property %s%s: %v", channel, property, err)
+			}
+
+			// Check if this property should be skipped based on merge preferences. Resets are
+			// never skipped since they are only useful when the property has a non-default value.
+			if mergeBehavior == MergeSoft && entry.Action == ActionSet {
 				// If there's actually a default and we have an actual current value
-				if defaultValue != "" && currentValue != "" {
-					if currentValue != defaultValue {
+				if hasDefault && hasCurrent {
+					if !currentValue.Equal(defaultValue) {
 						fmt.Printf("%s Skipping property %s%s with non-default value %s (default=%s)\n", yellow("•"), channel, property, currentValue, defaultValue)
 						continue
 					}
@@ -79,52 +121,116 @@ func applyProfile(profilePath string, mergeBehavior MergeBehavior, exclude Exclu
 				continue
 			}
 
-			dryRunNotice := ""
-			if dryRun {
-				dryRunNotice = " (skipping due to dry run)"
+			// xfconfd refuses to reset a property that does not exist
+			if entry.Action == ActionReset && !hasCurrent {
+				fmt.Printf("%s Skipping unset property %s%s\n", yellow("•"), channel, property)
+				continue
 			}
 
-			fmt.Printf("%s Setting %s%s ➔ %s%s\n", blue("•"), channel, property, fmt.Sprintf("%v", value), dryRunNotice)
+			// The same goes for removing a property when nothing is set below it either
+			var subtree map[string]Value
+			if entry.Action == ActionRemove {
+				values, err := backend.List(channel)
+				if err != nil {
+					return nil, err
+				}
+				subtree = make(map[string]Value)
+				for name, value := range values {
+					if name == property || isBelow(name, property) {
+						subtree[name] = value
+					}
+				}
+				if len(subtree) == 0 {
+					fmt.Printf("%s Skipping unset property %s%s\n", yellow("•"), channel, property)
+					continue
+				}
+			}
 
-			if dryRun {
+			if entry.Action == ActionSet && hasCurrent && currentValue.Equal(entry.Value) {
+				fmt.Printf("%s Skipping property %s%s already set to %s\n", yellow("•"), channel, property, currentValue)
 				continue
 			}
 
-			// We can definitely set this property now
-			var cmd *exec.Cmd
-			switch v := value.(type) {
-			case string:
-				cmd = exec.Command("xfconf-query", "-c", channel, "--property", property, "--type", "string", "--create", "--set", v)
-			case bool:
-				boolValue := "false"
-				if v {
-					boolValue = "true"
+			// Remember the state of everything about to change so that it can be restored
+			if entry.Action == ActionRemove {
+				// Like below, properties showing their default are restored by resetting them
+				names := slices.Sorted(maps.Keys(subtree))
+				subtreeDefaults, err := backend.Defaults(map[string][]string{channel: names})
+				if err != nil {
+					return nil, fmt.Errorf("could not get default property values: %v", err)
 				}
-				cmd = exec.Command("xfconf-query", "-c", channel, "--property", property, "--type", "bool", "--create", "--set", boolValue)
+				for _, name := range names {
+					value := subtree[name]
+					subtreeDefault, hasDefault := subtreeDefaults[channel][name]
+					isDefault := hasDefault && value.Equal(subtreeDefault)
+					changes.Revert.recordPrevious(channel, name, value.withTypesFrom(subtreeDefault), !isDefault)
+				}
+			} else {
+				// A property showing its default value is restored by resetting it, so that it keeps
+				// following the default. Properties whose type xfconf-query could not tell take the
+				// type of their default.
+				previous := currentValue.withTypesFrom(defaultValue).withTypesFrom(entry.Value)
+				isDefault := hasDefault && currentValue.Equal(defaultValue)
+				changes.Revert.recordPrevious(channel, property, previous, hasCurrent && !isDefault)
+			}
+			changes.Applied.addOnce(channel, property, entry.profileValue())
+
+			dryRunNotice := ""
+			if dryRun {
+				dryRunNotice = " (skipping due to dry run)"
+			}
+
+			switch entry.Action {
+			case ActionReset:
+				fmt.Printf("%s Resetting %s%s%s\n", blue("•"), channel, property, dryRunNotice)
+			case ActionRemove:
+				fmt.Printf("%s Removing %s%s%s\n", blue("•"), channel, property, dryRunNotice)
 			default:
-				return fmt.Errorf("unsupported value type for property %s: %T", property, value)
+				fmt.Printf("%s Setting %s%s ➔ %s%s\n", blue("•"), channel, property, entry.Value, dryRunNotice)
 			}
 
-			output, err := cmd.CombinedOutput()
+			// We can definitely change this property now
+			switch entry.Action {
+			case ActionReset:
+				err = backend.Reset(channel, property, false)
+			case ActionRemove:
+				err = backend.Reset(channel, property, true)
+			default:
+				err = backend.Set(channel, property, entry.Value)
+			}
 			if err != nil {
-				return fmt.Errorf("failed to run command: %v\nOutput: %s", err, string(output))
+				return nil, err
 			}
 		}
 	}
 
-	return nil
+	return changes, nil
 }
 
-func revertProfile(profilePath string, exclude ExcludePatterns, dryRun bool) error {
-	data, err := os.ReadFile(profilePath)
-	if err != nil {
-		return fmt.Errorf("failed to read file: %v", err)
+// Revert a profile. If the state of the properties before the profile was applied has been
+// recorded in a revert profile, exactly that state is restored. Otherwise every property of the
+// profile is reset.
+func revertProfile(backend Backend, profilePath string, revertPath string, exclude ExcludePatterns, dryRun bool) error {
+	if _, err := os.Stat(revertPath); err == nil {
+		revert, err := loadProfile(revertPath)
+		if err != nil {
+			return err
+		}
+		if err := restoreProfile(backend, revert, dryRun); err != nil {
+			return err
+		}
+		if dryRun {
+			return nil
+		}
+		if err := os.Remove(revertPath); err != nil {
+			return fmt.Errorf("failed to remove %s: %v", revertPath, err)
+		}
+		return nil
 	}
 
-	var profile Profile
-	err = json.Unmarshal(data, &profile)
+	profile, err := loadProfile(profilePath)
 	if err != nil {
-		return fmt.Errorf("failed to parse JSON: %v", err)
+		return err
 	}
 
 	blue := color.New(color.FgHiBlue).SprintFunc()
@@ -154,11 +260,8 @@ func revertProfile(profilePath string, exclude ExcludePatterns, dryRun bool) err
 			}
 
 			// We can definitely reset this property now
-			cmd := exec.Command("xfconf-query", "-c", channel, "--reset", "--property", property)
-
-			output, err := cmd.CombinedOutput()
-			if err != nil {
-				return fmt.Errorf("failed to run command: %v\nOutput: %s", err, string(output))
+			if err := backend.Reset(channel, property, false); err != nil {
+				return err
 			}
 		}
 	}
@@ -166,137 +269,37 @@ func revertProfile(profilePath string, exclude ExcludePatterns, dryRun bool) err
 	return nil
 }
 
-// Create $XDG_STATE_HOME/xfconf-profile/sync if needed
-func ensureStateDir() (string, error) {
-	xdgStateHome := os.Getenv("XDG_STATE_HOME")
-	var stateDirPath string
-
-	if xdgStateHome != "" {
-		stateDirPath = filepath.Join(xdgStateHome, "xfconf-profile", "sync")
-	} else {
-		homeDir, err := os.UserHomeDir()
-		if err != nil {
-			return "", fmt.Errorf("failed to get user home directory: %v", err)
-		}
-		stateDirPath = filepath.Join(homeDir, ".local", "state", "xfconf-profile", "sync")
-	}
-
-	if err := os.MkdirAll(stateDirPath, 0755); err != nil {
-		return "", fmt.Errorf("failed to create state directory: %v", err)
-	}
-
-	return stateDirPath, nil
-}
-
-func copyDistConfig(distConfig string, currentDir string) error {
-	defaultConfigData, err := os.ReadFile(distConfig)
-	if err != nil {
-		return fmt.Errorf("failed to read config: %v", err)
-	}
-
-	currentConfigPath := filepath.Join(currentDir, "profile.json")
-	if err := os.WriteFile(currentConfigPath, defaultConfigData, 0644); err != nil {
-		return fmt.Errorf("failed to write current config: %v", err)
-	}
-
-	return nil
-}
-
-func compareFiles(file1, file2 string) (bool, error) {
-	data1, err := os.ReadFile(file1)
-	if err != nil {
-		return false, fmt.Errorf("failed to read %s: %v", file1, err)
-	}
-
-	data2, err := os.ReadFile(file2)
-	if err != nil {
-		return false, fmt.Errorf("failed to read %s: %v", file2, err)
-	}
-
-	return string(data1) == string(data2), nil
-}
-
-func syncProfile(distConfig string, mergeBehavior MergeBehavior, exclude ExcludePatterns, dryRun bool) error {
-	stateDirPath, err := ensureStateDir()
-	if err != nil {
-		return err
-	}
-
-	_, err = os.Stat(distConfig)
-	if err != nil {
-		return err
-	}
+// Get the current value of each queried property that is set
+func gatherCurrentValues(backend Backend, queries map[string][]string) (map[string]map[string]Value, error) {
+	results := make(map[string]map[string]Value)
 
-	currentDir := filepath.Join(stateDirPath, "current")
-	previousDir := filepath.Join(stateDirPath, "previous")
+	for channel, properties := range queries {
+		results[channel] = make(map[string]Value)
 
-	// Abnormal case: reset state directory if it's invalid
-	if _, err := os.Stat(currentDir); errors.Is(err, os.ErrNotExist) {
-		if _, err := os.Stat(previousDir); err == nil {
-			fmt.Println("Invalid state: resetting data")
-			if err := os.RemoveAll(stateDirPath); err != nil {
-				return fmt.Errorf("failed to reset state directory: %v", err)
+		for _, property := range properties {
+			value, ok, err := backend.Get(channel, property)
+			if err != nil {
+				return nil, err
 			}
-			if _, err := ensureStateDir(); err != nil {
-				return err
+			if ok {
+				results[channel][property] = value
 			}
 		}
 	}
 
-	// TODO: applyProfile should return a new profile that only includes properties that
-	// were actually changed based on the user's merge options / current settings. We can
-	// still copy the distConfig but we should call it something like profile.json.orig to
-	// indicate that this is just for reference
-	//
-	// First run: initialize current directory
-	if _, err := os.Stat(currentDir); errors.Is(err, os.ErrNotExist) {
-		fmt.Println("Empty state")
-		if err := applyProfile(distConfig, mergeBehavior, exclude, dryRun); err != nil {
-			return err
-		}
-		if err := os.MkdirAll(currentDir, 0755); err != nil {
-			return fmt.Errorf("failed to create current directory: %v", err)
-		}
-		if err := copyDistConfig(distConfig, currentDir); err != nil {
-			return err
-		}
-		return nil
-	}
+	return results, nil
+}
 
-	// Steady run: move current to previous and apply new config
-	fmt.Println("Steady state")
-	if err := os.RemoveAll(previousDir); err != nil {
-		return fmt.Errorf("failed to remove previous directory: %v", err)
-	}
-	if err := os.Rename(currentDir, previousDir); err != nil {
-		return fmt.Errorf("failed to move current to previous: %v", err)
-	}
-	if err := os.MkdirAll(currentDir, 0755); err != nil {
-		return fmt.Errorf("failed to create current directory: %v", err)
-	}
-	if err := copyDistConfig(distConfig, currentDir); err != nil {
-		return err
+// The $XDG_STATE_HOME/xfconf-profile directory
+func stateHomeDir() (string, error) {
+	xdgStateHome := os.Getenv("XDG_STATE_HOME")
+	if xdgStateHome != "" {
+		return filepath.Join(xdgStateHome, "xfconf-profile"), nil
 	}
 
-	// Check if configurations differ
-	currentConfig := filepath.Join(currentDir, "profile.json")
-	previousConfig := filepath.Join(previousDir, "profile.json")
-	identical, err := compareFiles(currentConfig, previousConfig)
+	homeDir, err := os.UserHomeDir()
 	if err != nil {
-		return err
+		return "", fmt.Errorf("failed to get user home directory: %v", err)
 	}
-
-	if !identical {
-		fmt.Println("Configurations differ -- reverting old and applying new")
-		if err := revertProfile(previousConfig, exclude, dryRun); err != nil {
-			return err
-		}
-		if err := applyProfile(currentConfig, mergeBehavior, exclude, dryRun); err != nil {
-			return err
-		}
-	} else {
-		fmt.Println("Configurations identical -- no changes required")
-	}
-
-	return nil
+	return filepath.Join(homeDir, ".local", "state", "xfconf-profile"), nil
 }
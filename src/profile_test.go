@@ -0,0 +1,396 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// Properties of each channel, keyed by their fully qualified name such as xfwm4/general/theme
+type testValues map[string]Value
+
+func str(value string) Value {
+	return Value{Type: "string", Value: value}
+}
+
+// Split a fully qualified property name into its channel and property
+func splitName(name string) (string, string) {
+	channel, property, _ := strings.Cut(name, "/")
+	return channel, "/" + property
+}
+
+func (v testValues) byChannel() map[string]map[string]Value {
+	channels := make(map[string]map[string]Value)
+	for name, value := range v {
+		channel, property := splitName(name)
+		if channels[channel] == nil {
+			channels[channel] = make(map[string]Value)
+		}
+		channels[channel][property] = value
+	}
+	return channels
+}
+
+func newTestBackend(defaults, current testValues) *MemoryBackend {
+	backend := NewMemoryBackend()
+	backend.DefaultValues = defaults.byChannel()
+	backend.Properties = current.byChannel()
+	return backend
+}
+
+// Check that exactly the given properties are set, leaving out the ones showing their default
+func assertProperties(t *testing.T, backend *MemoryBackend, want testValues) {
+	t.Helper()
+
+	got := make(testValues)
+	for channel, properties := range backend.Properties {
+		for property, value := range properties {
+			got[channel+property] = value
+		}
+	}
+
+	for name, value := range want {
+		if gotValue, ok := got[name]; !ok {
+			t.Errorf("%s is not set, want %s %v", name, value.Type, value)
+		} else if gotValue.Type != value.Type || !gotValue.Equal(value) {
+			t.Errorf("%s is %s %v, want %s %v", name, gotValue.Type, gotValue, value.Type, value)
+		}
+	}
+	for name, value := range got {
+		if _, ok := want[name]; !ok {
+			t.Errorf("%s is set to %v, want it unset", name, value)
+		}
+	}
+}
+
+func parseTestProfile(t *testing.T, data string) *Profile {
+	t.Helper()
+	return loadTestProfile(t, writeTestFile(t, filepath.Join(t.TempDir(), "profile.json"), data))
+}
+
+func loadTestProfile(t *testing.T, path string) *Profile {
+	t.Helper()
+	profile, err := loadProfile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return profile
+}
+
+func writeTestFile(t *testing.T, path string, data string) string {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func appliedNames(profile *Profile) []string {
+	var names []string
+	for channel, properties := range profile.Properties {
+		for property := range properties {
+			names = append(names, channel+property)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
+
+func TestApplyProperties(t *testing.T) {
+	tests := []struct {
+		name     string
+		merge    MergeBehavior
+		exclude  []string
+		defaults testValues
+		current  testValues
+		profile  string
+		// The properties set afterwards, and the ones the apply recorded as changed
+		want        testValues
+		wantApplied []string
+	}{
+		{
+			name:        "soft merge sets properties at their default",
+			merge:       MergeSoft,
+			defaults:    testValues{"xsettings/Net/ThemeName": str("Adwaita")},
+			profile:     `{"properties": {"xsettings": {"/Net/ThemeName": "Chicago95"}}}`,
+			want:        testValues{"xsettings/Net/ThemeName": str("Chicago95")},
+			wantApplied: []string{"xsettings/Net/ThemeName"},
+		},
+		{
+			name:     "soft merge skips properties changed by the user",
+			merge:    MergeSoft,
+			defaults: testValues{"xsettings/Net/ThemeName": str("Adwaita")},
+			current:  testValues{"xsettings/Net/ThemeName": str("Mine")},
+			profile:  `{"properties": {"xsettings": {"/Net/ThemeName": "Chicago95"}}}`,
+			want:     testValues{"xsettings/Net/ThemeName": str("Mine")},
+		},
+		{
+			name:        "soft merge sets properties without a default",
+			merge:       MergeSoft,
+			profile:     `{"properties": {"xfwm4": {"/general/theme": "Chicago95"}}}`,
+			want:        testValues{"xfwm4/general/theme": str("Chicago95")},
+			wantApplied: []string{"xfwm4/general/theme"},
+		},
+		{
+			name:        "hard merge replaces properties changed by the user",
+			merge:       MergeHard,
+			defaults:    testValues{"xsettings/Net/ThemeName": str("Adwaita")},
+			current:     testValues{"xsettings/Net/ThemeName": str("Mine")},
+			profile:     `{"properties": {"xsettings": {"/Net/ThemeName": "Chicago95"}}}`,
+			want:        testValues{"xsettings/Net/ThemeName": str("Chicago95")},
+			wantApplied: []string{"xsettings/Net/ThemeName"},
+		},
+		{
+			name:    "hard merge skips excluded properties",
+			merge:   MergeHard,
+			exclude: []string{"^xsettings/Net"},
+			profile: `{"properties": {"xsettings": {"/Net/ThemeName": "Chicago95"}, "xfwm4": {"/general/theme": "Chicago95"}}}`,
+			want: testValues{
+				"xfwm4/general/theme": str("Chicago95"),
+			},
+			wantApplied: []string{"xfwm4/general/theme"},
+		},
+		{
+			name:        "force merge sets excluded properties",
+			merge:       MergeForce,
+			exclude:     []string{"^xsettings/Net"},
+			profile:     `{"properties": {"xsettings": {"/Net/ThemeName": "Chicago95"}}}`,
+			want:        testValues{"xsettings/Net/ThemeName": str("Chicago95")},
+			wantApplied: []string{"xsettings/Net/ThemeName"},
+		},
+		{
+			name:    "properties already set are skipped",
+			merge:   MergeHard,
+			current: testValues{"xfwm4/general/theme": str("Chicago95")},
+			profile: `{"properties": {"xfwm4": {"/general/theme": "Chicago95"}}}`,
+			want:    testValues{"xfwm4/general/theme": str("Chicago95")},
+		},
+		{
+			name:     "numbers take the type of the current value",
+			merge:    MergeHard,
+			defaults: testValues{"xfce4-panel/panels/panel-1/size": {Type: "uint", Value: "30"}},
+			profile:  `{"properties": {"xfce4-panel": {"/panels/panel-1/size": 28}}}`,
+			want: testValues{
+				"xfce4-panel/panels/panel-1/size": {Type: "uint", Value: "28"},
+			},
+			wantApplied: []string{"xfce4-panel/panels/panel-1/size"},
+		},
+		{
+			name:    "typed values and arrays keep their types",
+			merge:   MergeHard,
+			profile: `{"properties": {"xfce4-panel": {"/panels": [1, {"type": "uint", "value": 2}], "/dark-mode": true}}}`,
+			want: testValues{
+				"xfce4-panel/panels": {Type: "array", Items: []Value{
+					{Type: "int", Value: "1"},
+					{Type: "uint", Value: "2"},
+				}},
+				"xfce4-panel/dark-mode": {Type: "bool", Value: "true"},
+			},
+			wantApplied: []string{"xfce4-panel/dark-mode", "xfce4-panel/panels"},
+		},
+		{
+			name:        "resets are applied with soft merge",
+			merge:       MergeSoft,
+			defaults:    testValues{"xfwm4/general/theme": str("Default")},
+			current:     testValues{"xfwm4/general/theme": str("Mine")},
+			profile:     `{"properties": {"xfwm4": {"/general/theme": null}}}`,
+			want:        testValues{},
+			wantApplied: []string{"xfwm4/general/theme"},
+		},
+		{
+			name:    "resets of unset properties are skipped",
+			merge:   MergeSoft,
+			current: testValues{"xfwm4/general/title_font": str("Sans 9")},
+			profile: `{"properties": {"xfwm4": {"/general/theme": {"action": "reset"}}}}`,
+			want:    testValues{"xfwm4/general/title_font": str("Sans 9")},
+		},
+		{
+			name:  "remove resets the property and everything below it",
+			merge: MergeSoft,
+			current: testValues{
+				"xfce4-panel/plugins/plugin-12":      str("clock"),
+				"xfce4-panel/plugins/plugin-12/mode": {Type: "uint", Value: "2"},
+				"xfce4-panel/plugins/plugin-13":      str("menu"),
+			},
+			profile:     `{"properties": {"xfce4-panel": {"/plugins/plugin-12": {"action": "remove"}}}}`,
+			want:        testValues{"xfce4-panel/plugins/plugin-13": str("menu")},
+			wantApplied: []string{"xfce4-panel/plugins/plugin-12"},
+		},
+		{
+			name:    "removes with nothing below them are skipped",
+			merge:   MergeSoft,
+			current: testValues{"xfce4-panel/plugins/plugin-13": str("menu")},
+			profile: `{"properties": {"xfce4-panel": {"/plugins/plugin-12": {"action": "remove"}}}}`,
+			want:    testValues{"xfce4-panel/plugins/plugin-13": str("menu")},
+		},
+		{
+			name:    "X- keys are not channels",
+			merge:   MergeHard,
+			profile: `{"properties": {"X-comment": {"/a": "b"}, "xfwm4": {"/general/theme": "Chicago95"}}}`,
+			want:    testValues{"xfwm4/general/theme": str("Chicago95")},
+			wantApplied: []string{
+				"xfwm4/general/theme",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend := newTestBackend(test.defaults, test.current)
+			exclude := make(ExcludePatterns)
+			if err := exclude.add(test.exclude); err != nil {
+				t.Fatal(err)
+			}
+
+			changes, err := applyProperties(backend, parseTestProfile(t, test.profile), test.merge, exclude, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assertProperties(t, backend, test.want)
+			if got := appliedNames(changes.Applied); !slices.Equal(got, test.wantApplied) {
+				t.Errorf("applied %v, want %v", got, test.wantApplied)
+			}
+		})
+	}
+}
+
+func TestApplyDryRun(t *testing.T) {
+	current := testValues{"xfwm4/general/theme": str("Default")}
+	backend := newTestBackend(nil, current)
+
+	profile := `{"properties": {"xfwm4": {"/general/theme": "Chicago95", "/general/title_font": null}}}`
+	if _, err := applyProperties(backend, parseTestProfile(t, profile), MergeHard, nil, true); err != nil {
+		t.Fatal(err)
+	}
+	assertProperties(t, backend, current)
+}
+
+func TestApplyThenRevert(t *testing.T) {
+	tests := []struct {
+		name     string
+		defaults testValues
+		current  testValues
+		profile  string
+	}{
+		{
+			name:     "values picked by the user are restored",
+			defaults: testValues{"xfwm4/general/theme": str("Default")},
+			current:  testValues{"xfwm4/general/theme": str("Daloa")},
+			profile:  `{"properties": {"xfwm4": {"/general/theme": "Chicago95"}}}`,
+		},
+		{
+			name:     "properties showing their default are reset",
+			defaults: testValues{"xfwm4/general/theme": str("Default")},
+			profile:  `{"properties": {"xfwm4": {"/general/theme": "Chicago95"}}}`,
+		},
+		{
+			name:    "properties that did not exist are reset",
+			profile: `{"properties": {"xsettings": {"/Net/ThemeName": "Chicago95", "/Net/IconThemeName": "Chicago95"}}}`,
+		},
+		{
+			name:    "types are restored",
+			current: testValues{"xfce4-panel/panels/panel-1/size": {Type: "uint", Value: "30"}},
+			profile: `{"properties": {"xfce4-panel": {"/panels/panel-1/size": 28}}}`,
+		},
+		{
+			name:    "reset properties get their value back",
+			current: testValues{"xfwm4/general/theme": str("Daloa")},
+			profile: `{"properties": {"xfwm4": {"/general/theme": null}}}`,
+		},
+		{
+			name: "removed subtrees are restored",
+			current: testValues{
+				"xfce4-panel/plugins/plugin-12":      str("clock"),
+				"xfce4-panel/plugins/plugin-12/mode": {Type: "uint", Value: "2"},
+			},
+			profile: `{"properties": {"xfce4-panel": {"/plugins/plugin-12": {"action": "remove"}}}}`,
+		},
+		{
+			name: "removed subtrees keep following their defaults",
+			defaults: testValues{
+				"xfce4-panel/plugins/plugin-12":      str("clock"),
+				"xfce4-panel/plugins/plugin-12/mode": {Type: "uint", Value: "1"},
+			},
+			current: testValues{
+				"xfce4-panel/plugins/plugin-12/mode":   {Type: "uint", Value: "2"},
+				"xfce4-panel/plugins/plugin-12/format": str("%R"),
+			},
+			profile: `{"properties": {"xfce4-panel": {"/plugins/plugin-12": {"action": "remove"}}}}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("XDG_STATE_HOME", t.TempDir())
+			backend := newTestBackend(test.defaults, test.current)
+			profilePath := writeTestFile(t, filepath.Join(t.TempDir(), "profile.json"), test.profile)
+
+			changes, err := applyProfile(backend, profilePath, MergeHard, nil, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := saveRevertProfile(profilePath, Target{}, changes.Revert); err != nil {
+				t.Fatal(err)
+			}
+
+			revertPath, err := revertProfilePath(profilePath, Target{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := revertProfile(backend, profilePath, revertPath, nil, false); err != nil {
+				t.Fatal(err)
+			}
+
+			assertProperties(t, backend, test.current)
+			if _, err := os.Stat(revertPath); !os.IsNotExist(err) {
+				t.Errorf("the revert profile was kept after reverting")
+			}
+		})
+	}
+}
+
+func TestApplyTwiceKeepsTheFirstState(t *testing.T) {
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	current := testValues{"xfwm4/general/theme": str("Daloa")}
+	backend := newTestBackend(nil, current)
+	profilePath := filepath.Join(t.TempDir(), "profile.json")
+
+	for _, theme := range []string{"Chicago95", "Redmond"} {
+		data, _ := json.Marshal(map[string]any{"properties": map[string]any{"xfwm4": map[string]any{"/general/theme": theme}}})
+		writeTestFile(t, profilePath, string(data))
+		changes, err := applyProfile(backend, profilePath, MergeHard, nil, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := saveRevertProfile(profilePath, Target{}, changes.Revert); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	revertPath, _ := revertProfilePath(profilePath, Target{})
+	if err := revertProfile(backend, profilePath, revertPath, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	assertProperties(t, backend, current)
+}
+
+func TestRevertWithoutRecordResets(t *testing.T) {
+	backend := newTestBackend(nil, testValues{
+		"xfwm4/general/theme":      str("Chicago95"),
+		"xfwm4/general/title_font": str("Sans 9"),
+	})
+	profilePath := writeTestFile(t, filepath.Join(t.TempDir(), "profile.json"), `{"properties": {"xfwm4": {"/general/theme": "Chicago95"}}}`)
+
+	missing := filepath.Join(t.TempDir(), "missing.json")
+	if err := revertProfile(backend, profilePath, missing, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	assertProperties(t, backend, testValues{"xfwm4/general/title_font": str("Sans 9")})
+}
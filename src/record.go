@@ -0,0 +1,221 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"os/signal"
+	"regexp"
+	"slices"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/fatih/color"
+)
+
+// Formats that record can print changes in
+const (
+	RecordFormatCommands = "commands"
+	RecordFormatProfile  = "profile"
+)
+
+// RecordFilter selects the changes that are recorded
+type RecordFilter struct {
+	// Channels to record, or every channel if empty
+	Channels []string
+	// Patterns of which properties must match one, if any. Like exclude patterns, they are
+	// matched against the fully qualified name of the property.
+	Include []*regexp.Regexp
+	Exclude ExcludePatterns
+}
+
+// Create a filter from the patterns given on the command line, on top of the exclude patterns
+// from the config
+func newRecordFilter(channels, include, exclude []string, configExclude ExcludePatterns) (RecordFilter, error) {
+	filter := RecordFilter{Channels: channels, Exclude: make(ExcludePatterns)}
+
+	for _, pattern := range include {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return filter, fmt.Errorf("invalid include regular expression: %s", pattern)
+		}
+		filter.Include = append(filter.Include, re)
+	}
+
+	maps.Copy(filter.Exclude, configExclude)
+	if err := filter.Exclude.add(exclude); err != nil {
+		return filter, err
+	}
+
+	return filter, nil
+}
+
+// Whether changes to a property are recorded
+func (f RecordFilter) allows(channel, property string) bool {
+	if len(f.Channels) > 0 && !slices.Contains(f.Channels, channel) {
+		return false
+	}
+	if f.Exclude.IsExcluded(channel, property) {
+		return false
+	}
+	if len(f.Include) == 0 {
+		return true
+	}
+
+	representation := channel + property
+	for _, re := range f.Include {
+		if re.MatchString(representation) {
+			return true
+		}
+	}
+	return false
+}
+
+// Record changes to xfconf properties until interrupted, or for the given duration if it is not
+// zero. Changes are printed as xfconf-query commands, or collected into a profile that is written
+// to outputPath, or printed if it is empty, when recording stops. The profile's metadata gets the
+// given name and version, if any. backend chooses whether changes are seen through xfconfd's D-Bus
+// signals or its XML files.
+func recordProfile(backend string, filter RecordFilter, duration time.Duration, format, outputPath, name, version string) error {
+	if format != RecordFormatCommands && format != RecordFormatProfile {
+		return fmt.Errorf("invalid format: must be '%s' or '%s'", RecordFormatCommands, RecordFormatProfile)
+	}
+
+	watcher, err := openChangeWatcher(backend)
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	return recordChanges(watcher, filter, duration, format, outputPath, name, version)
+}
+
+// Record the changes reported by a watcher, as recordProfile does
+func recordChanges(watcher ChangeWatcher, filter RecordFilter, duration time.Duration, format, outputPath, name, version string) error {
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupt)
+
+	// Without a duration, the timeout never fires
+	var timeout <-chan time.Time
+	if duration > 0 {
+		timeout = time.After(duration)
+		fmt.Fprintf(os.Stderr, "Recording changes to xfconf for %s... Press Ctrl-C to stop early\n", duration)
+	} else {
+		fmt.Fprintln(os.Stderr, "Recording changes to xfconf... Press Ctrl-C to stop")
+	}
+	blue := color.New(color.FgHiBlue).SprintFunc()
+	yellow := color.New(color.FgHiYellow).SprintFunc()
+
+	recorded := newProfile()
+	stop := func() error {
+		if format == RecordFormatProfile {
+			return writeRecordedProfile(recorded, outputPath, name, version)
+		}
+		return nil
+	}
+
+	for {
+		var changes []PropertyChange
+		select {
+		case <-interrupt:
+			return stop()
+		case <-timeout:
+			fmt.Fprintf(os.Stderr, "Stopped recording after %s\n", duration)
+			return stop()
+		case batch, ok := <-watcher.Changes():
+			if !ok {
+				// Keep what was recorded until watching failed
+				if err := stop(); err != nil {
+					return err
+				}
+				return watcher.Err()
+			}
+			changes = batch
+		}
+
+		for _, change := range changes {
+			if !filter.allows(change.Channel, change.Property) {
+				logger.Debug("Skipping filtered out property", "property", change.Channel+change.Property)
+				continue
+			}
+
+			if format == RecordFormatCommands {
+				if change.Removed {
+					fmt.Printf("%s %s\n", blue("•"), resetCommand(change.Channel, change.Property))
+				} else if command, err := queryCommand(change.Channel, change.Property, change.Value); err != nil {
+					fmt.Fprintf(os.Stderr, "%s Cannot record %s%s as a command: %v\n", yellow("•"), change.Channel, change.Property, err)
+				} else {
+					fmt.Printf("%s %s\n", blue("•"), command)
+				}
+				continue
+			}
+
+			if recorded.Properties[change.Channel] == nil {
+				recorded.Properties[change.Channel] = make(map[string]any)
+			}
+			// Removed properties are recorded as resets, so that replaying the profile removes
+			// them as well
+			if change.Removed {
+				recorded.Properties[change.Channel][change.Property] = nil
+				fmt.Fprintf(os.Stderr, "%s Recording reset of %s%s\n", blue("•"), change.Channel, change.Property)
+				continue
+			}
+			recorded.Properties[change.Channel][change.Property] = recordedValue(change.Value)
+			fmt.Fprintf(os.Stderr, "%s Recording %s%s ➔ %s\n", blue("•"), change.Channel, change.Property, change.Value)
+		}
+	}
+}
+
+// The value as written in a recorded profile. Strings and booleans are written as bare JSON values,
+// which are read back with the same type, and everything else keeps the type from the XML.
+func recordedValue(v Value) any {
+	switch v.Type {
+	case "string":
+		return v.Value
+	case "bool":
+		return v.Value == "true"
+	case "array":
+		items := make([]any, len(v.Items))
+		for i, item := range v.Items {
+			items[i] = recordedValue(item)
+		}
+		return items
+	default:
+		return v.profileValue()
+	}
+}
+
+func writeRecordedProfile(profile *Profile, outputPath, name, version string) error {
+	if name != "" {
+		profile.Metadata = map[string]any{"name": name}
+	}
+	if version != "" {
+		if profile.Metadata == nil {
+			profile.Metadata = make(map[string]any)
+		}
+		// Versions are numbers in the distribution's profiles, but any string will do
+		if number, err := strconv.Atoi(version); err == nil {
+			profile.Metadata["version"] = number
+		} else {
+			profile.Metadata["version"] = version
+		}
+	}
+
+	if outputPath != "" {
+		if err := saveProfile(outputPath, profile); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Wrote the recorded profile to %s\n", outputPath)
+		return nil
+	}
+
+	data, err := json.MarshalIndent(profile, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode profile: %v", err)
+	}
+	fmt.Println(string(data))
+	return nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRecordedValue(t *testing.T) {
+	tests := []struct {
+		value Value
+		// The value as it appears in the JSON of the profile
+		want string
+	}{
+		{value: Value{Type: "string", Value: "Chicago95"}, want: `"Chicago95"`},
+		{value: Value{Type: "bool", Value: "true"}, want: `true`},
+		{value: Value{Type: "int", Value: "-3"}, want: `{"type":"int","value":"-3"}`},
+		{value: Value{Type: "uint", Value: "28"}, want: `{"type":"uint","value":"28"}`},
+		{value: Value{Type: "double", Value: "1.5"}, want: `{"type":"double","value":"1.5"}`},
+		{
+			value: Value{Type: "array", Items: []Value{
+				{Type: "int", Value: "1"},
+				{Type: "string", Value: "two"},
+			}},
+			want: `[{"type":"int","value":"1"},"two"]`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value.Type, func(t *testing.T) {
+			data, err := json.Marshal(recordedValue(test.value))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != test.want {
+				t.Errorf("recorded as %s, want %s", data, test.want)
+			}
+
+			// Applying the recorded profile sets the same value with the same type
+			profile := parseTestProfile(t, `{"properties": {"test": {"/value": `+string(data)+`}}}`)
+			entry, err := parseProfileEntry(profile.Properties["test"]["/value"], "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if entry.Value.Type != test.value.Type || !entry.Value.Equal(test.value) {
+				t.Errorf("read back as %s %v", entry.Value.Type, entry.Value)
+			}
+		})
+	}
+}
+
+func TestWriteRecordedProfile(t *testing.T) {
+	tests := []struct {
+		name         string
+		profileName  string
+		version      string
+		wantMetadata map[string]any
+	}{
+		{name: "no metadata"},
+		{name: "name", profileName: "Chicago95", wantMetadata: map[string]any{"name": "Chicago95"}},
+		{name: "numeric version", version: "3", wantMetadata: map[string]any{"version": json.Number("3")}},
+		{
+			name:         "name and version",
+			profileName:  "Chicago95",
+			version:      "3.1",
+			wantMetadata: map[string]any{"name": "Chicago95", "version": "3.1"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			recorded := newProfile()
+			recorded.addOnce("xfwm4", "/general/theme", "Chicago95")
+
+			output := filepath.Join(t.TempDir(), "recorded.json")
+			if err := writeRecordedProfile(recorded, output, test.profileName, test.version); err != nil {
+				t.Fatal(err)
+			}
+
+			profile := loadTestProfile(t, output)
+			if !reflect.DeepEqual(profile.Metadata, test.wantMetadata) {
+				t.Errorf("metadata is %v, want %v", profile.Metadata, test.wantMetadata)
+			}
+			if got := profile.Properties["xfwm4"]["/general/theme"]; got != "Chicago95" {
+				t.Errorf("recorded /general/theme as %v", got)
+			}
+		})
+	}
+}
+
+func TestQueryCommand(t *testing.T) {
+	tests := []struct {
+		name  string
+		value Value
+		want  string
+	}{
+		{
+			name:  "scalar",
+			value: Value{Type: "uint", Value: "28"},
+			want:  `xfconf-query --create -c 'xfce4-panel' -p '/panels' --type 'uint' --set '28'`,
+		},
+		{
+			name:  "value looking like an option",
+			value: Value{Type: "string", Value: "--set"},
+			want:  `xfconf-query --create -c 'xfce4-panel' -p '/panels' --type 'string' --set '--set'`,
+		},
+		{
+			name: "array",
+			value: Value{Type: "array", Items: []Value{
+				{Type: "int", Value: "1"},
+				{Type: "string", Value: "it's"},
+			}},
+			want: `xfconf-query --create -c 'xfce4-panel' -p '/panels' --force-array --type 'int' --set '1' --type 'string' --set 'it'\''s'`,
+		},
+		{
+			name:  "single element array",
+			value: Value{Type: "array", Items: []Value{{Type: "int", Value: "1"}}},
+			want:  `xfconf-query --create -c 'xfce4-panel' -p '/panels' --force-array --type 'int' --set '1'`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := queryCommand("xfce4-panel", "/panels", test.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != test.want {
+				t.Errorf("got %s\nwant %s", got, test.want)
+			}
+		})
+	}
+
+	// xfconf-query has no way to create an empty array
+	if _, err := queryCommand("xfce4-panel", "/panels", Value{Type: "array", Items: []Value{}}); err == nil {
+		t.Error("got a command for an empty array")
+	}
+}
+
+func TestResetCommand(t *testing.T) {
+	want := `xfconf-query -c 'xfwm4' -p '/general/theme' --reset`
+	if got := resetCommand("xfwm4", "/general/theme"); got != want {
+		t.Errorf("got %s\nwant %s", got, want)
+	}
+}
+
+func TestRecordFilter(t *testing.T) {
+	configExclude := make(ExcludePatterns)
+	if err := configExclude.add([]string{"^xfwm4/general/workspace_names$"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		channels []string
+		include  []string
+		exclude  []string
+		allowed  []string
+		filtered []string
+	}{
+		{
+			name:     "everything but the config's exclude patterns",
+			allowed:  []string{"xfwm4/general/theme", "thunar/last-view"},
+			filtered: []string{"xfwm4/general/workspace_names"},
+		},
+		{
+			name:     "channels",
+			channels: []string{"xfwm4", "xsettings"},
+			allowed:  []string{"xfwm4/general/theme", "xsettings/Net/ThemeName"},
+			filtered: []string{"thunar/last-view", "xfwm4/general/workspace_names"},
+		},
+		{
+			name:     "include patterns",
+			include:  []string{"theme", "^xsettings/Net/"},
+			allowed:  []string{"xfwm4/general/theme", "xsettings/Net/IconThemeName"},
+			filtered: []string{"xfwm4/general/title_font", "xsettings/Gtk/FontName"},
+		},
+		{
+			name:     "exclude patterns add to the config's",
+			exclude:  []string{"^thunar/last-"},
+			allowed:  []string{"thunar/misc-single-click", "xfwm4/general/theme"},
+			filtered: []string{"thunar/last-view", "xfwm4/general/workspace_names"},
+		},
+		{
+			name:     "channels, include and exclude patterns together",
+			channels: []string{"xfwm4"},
+			include:  []string{"^xfwm4/general/"},
+			exclude:  []string{"_font$"},
+			allowed:  []string{"xfwm4/general/theme"},
+			filtered: []string{"xfwm4/general/title_font", "xfwm4/shortcuts/close", "xsettings/general/theme"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filter, err := newRecordFilter(test.channels, test.include, test.exclude, configExclude)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range test.allowed {
+				if channel, property := splitName(name); !filter.allows(channel, property) {
+					t.Errorf("%s is filtered out", name)
+				}
+			}
+			for _, name := range test.filtered {
+				if channel, property := splitName(name); filter.allows(channel, property) {
+					t.Errorf("%s is recorded", name)
+				}
+			}
+		})
+	}
+
+	// The patterns given on the command line do not change the config's
+	if _, err := newRecordFilter(nil, nil, []string{"^thunar/"}, configExclude); err != nil {
+		t.Fatal(err)
+	}
+	if configExclude.IsExcluded("thunar", "/last-view") {
+		t.Error("the exclude patterns were added to the config's")
+	}
+}
+
+func TestRecordFilterInvalidPatterns(t *testing.T) {
+	if _, err := newRecordFilter(nil, []string{"theme("}, nil, nil); err == nil {
+		t.Error("an invalid include pattern was accepted")
+	}
+	if _, err := newRecordFilter(nil, nil, []string{"[theme"}, nil); err == nil {
+		t.Error("an invalid exclude pattern was accepted")
+	}
+}
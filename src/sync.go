@@ -0,0 +1,479 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+
+	"github.com/fatih/color"
+)
+
+// The $XDG_STATE_HOME/xfconf-profile/sync directory
+func syncStateDir() (string, error) {
+	stateHome, err := stateHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(stateHome, "sync"), nil
+}
+
+// Create $XDG_STATE_HOME/xfconf-profile/sync if needed
+func ensureStateDir() (string, error) {
+	stateDirPath, err := syncStateDir()
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(stateDirPath, 0755); err != nil {
+		return "", fmt.Errorf("failed to create state directory: %v", err)
+	}
+
+	return stateDirPath, nil
+}
+
+// Files kept in each state directory
+const (
+	// The distribution's profile as it was when synced
+	origProfileFile = "profile.json.orig"
+	// The properties that were actually changed when syncing the distribution's profile
+	appliedProfileFile = "profile.json"
+	// Restores the properties that were changed to their state before syncing
+	revertProfileFile = "revert.json"
+)
+
+// The distribution's profile kept in a state directory. Older versions kept it as profile.json.
+func origProfilePath(stateDir string) string {
+	origPath := filepath.Join(stateDir, origProfileFile)
+	if _, err := os.Stat(origPath); errors.Is(err, os.ErrNotExist) {
+		return filepath.Join(stateDir, appliedProfileFile)
+	}
+	return origPath
+}
+
+// Save the changes made while syncing into a state directory
+func saveAppliedChanges(stateDir string, changes *AppliedChanges) error {
+	if err := saveProfile(filepath.Join(stateDir, appliedProfileFile), changes.Applied); err != nil {
+		return err
+	}
+	return saveProfile(filepath.Join(stateDir, revertProfileFile), changes.Revert)
+}
+
+// Copy a state file if it exists
+func copyStateFile(fromPath string, toPath string) error {
+	data, err := os.ReadFile(fromPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", fromPath, err)
+	}
+
+	if err := os.WriteFile(toPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %v", toPath, err)
+	}
+	return nil
+}
+
+// Read a profile kept in a state directory, or an empty one if the file does not exist
+func loadStateProfile(path string) (*Profile, bool, error) {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return newProfile(), false, nil
+	}
+
+	profile, err := loadProfile(path)
+	if err != nil {
+		return nil, false, err
+	}
+	if profile.Properties == nil {
+		profile.Properties = make(Properties)
+	}
+	return profile, true, nil
+}
+
+// Read the changes saved in a state directory. The returned flag tells whether the state before
+// syncing was recorded, which older versions did not do.
+func loadAppliedChanges(stateDir string) (*AppliedChanges, bool, error) {
+	applied, _, err := loadStateProfile(filepath.Join(stateDir, appliedProfileFile))
+	if err != nil {
+		return nil, false, err
+	}
+
+	revert, hasRevert, err := loadStateProfile(filepath.Join(stateDir, revertProfileFile))
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &AppliedChanges{Applied: applied, Revert: revert}, hasRevert, nil
+}
+
+// Sync the distribution's profile. Each version of the profile that gets synced is kept in the
+// state directory as a generation along with what it changed, up to the given number of
+// generations. A dry run only reads the state directory, and prints what a real sync would revert
+// and apply.
+func syncProfile(backend Backend, distConfig string, mergeBehavior MergeBehavior, exclude ExcludePatterns, history int, dryRun bool) error {
+	dist, err := loadDistProfile(distConfig)
+	if err != nil {
+		return err
+	}
+	if err := dist.addOverrides(getOverridesPath()); err != nil {
+		return err
+	}
+
+	if dryRun {
+		fmt.Println("Dry run -- the state directory is left unchanged")
+	}
+
+	generations, err := openSyncState(dryRun)
+	if err != nil {
+		return err
+	}
+
+	// First run: apply the whole profile
+	if len(generations) == 0 {
+		fmt.Println("Empty state")
+		changes, err := applyDistProfile(backend, dist, mergeBehavior, exclude, dryRun)
+		if err != nil {
+			return err
+		}
+		if dryRun {
+			return nil
+		}
+		_, err = saveGeneration(dist, changes, 0, "", history)
+		return err
+	}
+
+	// Steady run: compare with the profile synced last. The distribution's profile and the user's
+	// overrides are compared separately, so that a change to the overrides alone does not bring
+	// back a distribution's profile that was rolled back from.
+	fmt.Println("Steady state")
+	latest := generations[len(generations)-1]
+	stored, err := loadGenerationProfile(latest.Dir)
+	if err != nil {
+		return err
+	}
+	sameDist, sameData, err := dist.compare(latest.distProfilePath())
+	if err != nil {
+		return err
+	}
+	sameOverrides := sameProperties(stored.Overrides, dist.Overrides)
+
+	if sameDist && sameOverrides {
+		if latest.RollbackOf != 0 {
+			fmt.Printf("Configurations identical to the one rolled back from -- keeping generation %d\n", latest.RollbackOf)
+		} else {
+			fmt.Println("Configurations identical -- no changes required")
+		}
+		if !sameData && !dryRun {
+			// Only formatting or metadata changed, which the state should still reflect
+			fmt.Println("Updating the stored profile")
+			return latest.updateProfile(dist)
+		}
+		return nil
+	}
+
+	target := dist
+	rollbackOf := 0
+	skipped := ""
+	if sameDist {
+		fmt.Println("Overrides differ -- applying the changes")
+		// The profile restored by a rollback stays in place of the one turned down
+		if latest.RollbackOf != 0 {
+			target = stored
+			target.setOverrides(dist.Overrides, dist.OverridesData)
+			rollbackOf = latest.RollbackOf
+			skipped = latest.distProfilePath()
+		}
+	} else {
+		fmt.Println("Configurations differ -- applying the changes")
+	}
+
+	changes, err := syncDelta(backend, latest.Dir, target.Profile, target.forced(), mergeBehavior, exclude, dryRun)
+	if err != nil {
+		return err
+	}
+	if dryRun {
+		return nil
+	}
+	_, err = saveGeneration(target, changes, rollbackOf, skipped, history)
+	return err
+}
+
+// Apply the whole distribution's profile, followed by the user's overrides, which are applied
+// regardless of the merge behavior and exclude patterns
+func applyDistProfile(backend Backend, dist *DistProfile, mergeBehavior MergeBehavior, exclude ExcludePatterns, dryRun bool) (*AppliedChanges, error) {
+	// The overrides of a dry run see the profile as if it was applied
+	if dryRun {
+		backend = newPreviewBackend(backend)
+	}
+
+	forced := dist.forced()
+	profile := newProfile()
+	overrides := newProfile()
+	for channel, properties := range dist.Profile.Properties {
+		for property, value := range properties {
+			if forced.has(channel, property) {
+				overrides.addOnce(channel, property, value)
+			} else {
+				profile.addOnce(channel, property, value)
+			}
+		}
+	}
+
+	changes, err := applyProperties(backend, profile, mergeBehavior, exclude, dryRun)
+	if err != nil {
+		return nil, err
+	}
+
+	overrideChanges, err := applyProperties(backend, overrides, MergeForce, exclude, dryRun)
+	if err != nil {
+		return nil, err
+	}
+
+	changes.add(overrideChanges)
+	return changes, nil
+}
+
+// ProfileDelta describes how a profile changed between two versions
+type ProfileDelta struct {
+	// Updated holds the properties that were added or changed, with their new value
+	Updated *Profile
+	// Dropped lists the properties of each channel that were removed or changed, whose old
+	// value no longer applies
+	Dropped map[string][]string
+}
+
+// Compare two versions of a profile property by property. Values are compared by meaning, so
+// that 1 and {"type": "int", "value": 1} are the same.
+func diffProfiles(oldVersion, newVersion *Profile) ProfileDelta {
+	delta := ProfileDelta{Updated: newProfile(), Dropped: make(map[string][]string)}
+
+	oldQueries := oldVersion.Properties.queries()
+	newQueries := newVersion.Properties.queries()
+
+	for channel, properties := range newQueries {
+		for _, property := range properties {
+			newValue := newVersion.Properties[channel][property]
+			oldValue, existed := oldVersion.Properties[channel][property]
+			if existed && sameEntry(oldValue, newValue) {
+				continue
+			}
+			delta.Updated.addOnce(channel, property, newValue)
+			if existed {
+				delta.Dropped[channel] = append(delta.Dropped[channel], property)
+			}
+		}
+	}
+
+	for channel, properties := range oldQueries {
+		for _, property := range properties {
+			if _, ok := newVersion.Properties[channel][property]; !ok {
+				delta.Dropped[channel] = append(delta.Dropped[channel], property)
+			}
+		}
+	}
+
+	return delta
+}
+
+// Check whether two raw profile values have the same effect
+func sameEntry(a, b any) bool {
+	entryA, errA := parseProfileEntry(a, "")
+	entryB, errB := parseProfileEntry(b, "")
+	if errA != nil || errB != nil {
+		return reflect.DeepEqual(a, b)
+	}
+
+	if entryA.Action != entryB.Action {
+		return false
+	}
+	return entryA.Action != ActionSet || entryA.Value.Equal(entryB.Value)
+}
+
+// Check whether a property changed by the previous version of a profile is affected by a delta. A
+// removed property also covers the properties below it, which were recorded individually.
+func (d ProfileDelta) drops(previous *Profile, channel, property string) bool {
+	for _, dropped := range d.Dropped[channel] {
+		if property == dropped {
+			return true
+		}
+		entry, err := parseProfileEntry(previous.Properties[channel][dropped], "")
+		if err == nil && entry.Action == ActionRemove && isBelow(property, dropped) {
+			return true
+		}
+	}
+	return false
+}
+
+// A set of properties of each channel
+type propertySet map[string]map[string]bool
+
+func (s propertySet) add(channel, property string) {
+	if s[channel] == nil {
+		s[channel] = make(map[string]bool)
+	}
+	s[channel][property] = true
+}
+
+func (s propertySet) has(channel, property string) bool {
+	return s[channel][property]
+}
+
+// Update the settings from the profile of the previous sync to the current one. Only the
+// properties that differ between the two are touched, and the rest is left alone.
+//
+// The value the previous sync applied to a property is the base of a three-way merge with the
+// user's current value and the profile's new one. A property the user changed since is theirs and
+// is kept as is. An untouched property follows the profile: it is set to its new value, or restored
+// to its state before syncing if it was removed from the profile.
+func syncDelta(backend Backend, previousDir string, newVersion *Profile, forced propertySet, mergeBehavior MergeBehavior, exclude ExcludePatterns, dryRun bool) (*AppliedChanges, error) {
+	// The steps of a dry run see the changes of the ones before them, such as undone properties
+	if dryRun {
+		backend = newPreviewBackend(backend)
+	}
+
+	previousProfile, err := loadGenerationProfile(previousDir)
+	if err != nil {
+		return nil, err
+	}
+	oldVersion := previousProfile.Profile
+	wasForced := previousProfile.forced()
+	delta := diffProfiles(oldVersion, newVersion)
+
+	previous, hasRevert, err := loadAppliedChanges(previousDir)
+	if err != nil {
+		return nil, err
+	}
+
+	yellow := color.New(color.FgHiYellow).SprintFunc()
+
+	// Compare the properties that changed in the profile against what the previous sync set them to
+	followed := newProfile()
+	overridden := newProfile()
+	following := make(propertySet)
+	userChanged := make(propertySet)
+	for _, channel := range slices.Sorted(maps.Keys(delta.Dropped)) {
+		for _, property := range delta.Dropped[channel] {
+			// The user's overrides win even over their own changes
+			if newValue, ok := newVersion.Properties[channel][property]; ok && forced.has(channel, property) {
+				overridden.addOnce(channel, property, newValue)
+				following.add(channel, property)
+				continue
+			}
+
+			// A property no longer overridden goes back to its state before syncing, then the
+			// distribution's value is applied like any other
+			if wasForced.has(channel, property) {
+				continue
+			}
+
+			base, ok := previous.Applied.Properties[channel][property]
+			if !ok {
+				continue
+			}
+
+			current, isSet, err := backend.Get(channel, property)
+			if err != nil {
+				return nil, err
+			}
+
+			// Only values that were set can tell whether the user changed them since
+			baseEntry, err := parseProfileEntry(base, current.typeHint())
+			if err != nil || baseEntry.Action != ActionSet {
+				continue
+			}
+
+			if !isSet || !current.Equal(baseEntry.Value) {
+				if isSet {
+					fmt.Printf("%s Keeping property %s%s changed by the user to %s\n", yellow("•"), channel, property, current)
+				} else {
+					fmt.Printf("%s Keeping property %s%s reset by the user\n", yellow("•"), channel, property)
+				}
+				userChanged.add(channel, property)
+				continue
+			}
+
+			if newValue, ok := newVersion.Properties[channel][property]; ok {
+				followed.addOnce(channel, property, newValue)
+				following.add(channel, property)
+			}
+		}
+	}
+
+	// Split what the previous sync did into what has to be undone and what stays. Properties
+	// changed by the user are forgotten since they are no longer ours.
+	undo := newProfile()
+	kept := &AppliedChanges{Applied: newProfile(), Revert: newProfile()}
+	for channel, properties := range previous.Revert.Properties {
+		for property, value := range properties {
+			switch {
+			case userChanged.has(channel, property):
+			case !following.has(channel, property) && delta.drops(oldVersion, channel, property):
+				undo.addOnce(channel, property, value)
+			default:
+				kept.Revert.addOnce(channel, property, value)
+			}
+		}
+	}
+	for channel, properties := range previous.Applied.Properties {
+		for property, value := range properties {
+			switch {
+			case userChanged.has(channel, property):
+			case !following.has(channel, property) && delta.drops(oldVersion, channel, property):
+				if !hasRevert {
+					// Without a record of the state before syncing, all we can do is reset
+					undo.addOnce(channel, property, nil)
+				}
+			default:
+				kept.Applied.addOnce(channel, property, value)
+			}
+		}
+	}
+
+	// Properties still following the profile take their new value regardless of the merge
+	// behavior, which would otherwise mistake the value synced before for a change by the user
+	updated := newProfile()
+	for channel, properties := range delta.Updated.Properties {
+		for property, value := range properties {
+			switch {
+			case userChanged.has(channel, property) || following.has(channel, property):
+			case forced.has(channel, property):
+				overridden.addOnce(channel, property, value)
+			default:
+				updated.addOnce(channel, property, value)
+			}
+		}
+	}
+
+	if err := restoreProfile(backend, undo, dryRun); err != nil {
+		return nil, err
+	}
+
+	followMerge := MergeHard
+	if mergeBehavior == MergeForce {
+		followMerge = MergeForce
+	}
+	followChanges, err := applyProperties(backend, followed, followMerge, exclude, dryRun)
+	if err != nil {
+		return nil, err
+	}
+
+	updateChanges, err := applyProperties(backend, updated, mergeBehavior, exclude, dryRun)
+	if err != nil {
+		return nil, err
+	}
+
+	overrideChanges, err := applyProperties(backend, overridden, MergeForce, exclude, dryRun)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := kept
+	changes.add(followChanges)
+	changes.add(updateChanges)
+	changes.add(overrideChanges)
+	return changes, nil
+}
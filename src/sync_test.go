@@ -0,0 +1,583 @@
+package main
+
+import (
+	"io"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// syncStep is one thing happening between two syncs. Each field is optional.
+type syncStep struct {
+	// A new version of the distribution's profile
+	dist string
+	// Drop-ins of the distribution's profile, by file name
+	dropins map[string]string
+	// New overrides of the user, or "-" to remove them
+	overrides string
+	// Properties the user changes before syncing
+	edits testValues
+	// Roll back to the previous generation instead of syncing
+	rollback bool
+
+	// The properties set afterwards, and the number of generations kept
+	want            testValues
+	wantGenerations int
+}
+
+// syncScenario is a series of syncs starting from an empty state
+type syncScenario struct {
+	name     string
+	defaults testValues
+	// The number of generations to keep, or 5 if zero
+	history int
+	steps   []syncStep
+}
+
+// A distribution's profile setting the given string properties
+func distProfile(properties string) string {
+	return `{"properties": {"xsettings": {` + properties + `}}}`
+}
+
+func runSyncScenarios(t *testing.T, scenarios []syncScenario) {
+	t.Helper()
+	for _, scenario := range scenarios {
+		t.Run(scenario.name, func(t *testing.T) {
+			runSyncSteps(t, scenario)
+		})
+	}
+}
+
+// syncEnv is a user's session with its own state and config directories
+type syncEnv struct {
+	backend  *MemoryBackend
+	distPath string
+	history  int
+}
+
+func newSyncEnv(t *testing.T, defaults testValues, history int) *syncEnv {
+	t.Helper()
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+
+	if history == 0 {
+		history = 5
+	}
+	return &syncEnv{
+		backend:  newTestBackend(defaults, nil),
+		distPath: filepath.Join(t.TempDir(), "default.json"),
+		history:  history,
+	}
+}
+
+// Make the changes of a step to the profiles and the user's settings
+func (e *syncEnv) prepare(t *testing.T, step syncStep) {
+	t.Helper()
+
+	if step.dist != "" {
+		writeTestFile(t, e.distPath, step.dist)
+	}
+	for name, data := range step.dropins {
+		writeTestFile(t, filepath.Join(dropinDir(e.distPath), name), data)
+	}
+	switch step.overrides {
+	case "":
+	case "-":
+		if err := os.Remove(getOverridesPath()); err != nil {
+			t.Fatal(err)
+		}
+	default:
+		writeTestFile(t, getOverridesPath(), step.overrides)
+	}
+	for name, value := range step.edits {
+		channel, property := splitName(name)
+		e.backend.Set(channel, property, value)
+	}
+}
+
+// Sync, or roll back if the step says so
+func (e *syncEnv) run(step syncStep, dryRun bool) error {
+	if step.rollback {
+		return rollbackSync(e.backend, 0, MergeSoft, nil, e.history, dryRun)
+	}
+	return syncProfile(e.backend, e.distPath, MergeSoft, nil, e.history, dryRun)
+}
+
+func (e *syncEnv) generations(t *testing.T) int {
+	t.Helper()
+
+	stateDir, err := syncStateDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	generations, err := listGenerations(stateDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(generations)
+}
+
+func runSyncSteps(t *testing.T, scenario syncScenario) {
+	t.Helper()
+	env := newSyncEnv(t, scenario.defaults, scenario.history)
+
+	for i, step := range scenario.steps {
+		env.prepare(t, step)
+		if err := env.run(step, false); err != nil {
+			t.Fatalf("step %d: %v", i+1, err)
+		}
+
+		t.Logf("step %d", i+1)
+		assertProperties(t, env.backend, step.want)
+		if got := env.generations(t); got != step.wantGenerations {
+			t.Errorf("step %d: %d generations, want %d", i+1, got, step.wantGenerations)
+		}
+	}
+}
+
+func TestSyncDelta(t *testing.T) {
+	runSyncScenarios(t, []syncScenario{
+		{
+			name:     "the first sync applies the whole profile",
+			defaults: testValues{"xsettings/Net/ThemeName": str("Adwaita")},
+			steps: []syncStep{
+				{
+					dist: distProfile(`"/Net/ThemeName": "Chicago95", "/Net/IconThemeName": "Chicago95"`),
+					want: testValues{
+						"xsettings/Net/ThemeName":     str("Chicago95"),
+						"xsettings/Net/IconThemeName": str("Chicago95"),
+					},
+					wantGenerations: 1,
+				},
+			},
+		},
+		{
+			name: "changed properties follow the profile",
+			steps: []syncStep{
+				{
+					dist:            distProfile(`"/Net/ThemeName": "Chicago95", "/Net/IconThemeName": "Chicago95"`),
+					want:            testValues{"xsettings/Net/ThemeName": str("Chicago95"), "xsettings/Net/IconThemeName": str("Chicago95")},
+					wantGenerations: 1,
+				},
+				{
+					dist:            distProfile(`"/Net/ThemeName": "Redmond", "/Net/IconThemeName": "Chicago95"`),
+					want:            testValues{"xsettings/Net/ThemeName": str("Redmond"), "xsettings/Net/IconThemeName": str("Chicago95")},
+					wantGenerations: 2,
+				},
+			},
+		},
+		{
+			name:     "properties dropped from the profile get their previous value back",
+			defaults: testValues{"xsettings/Net/ThemeName": str("Adwaita")},
+			steps: []syncStep{
+				{
+					dist:            `{"properties": {}}`,
+					edits:           testValues{"xsettings/Gtk/FontName": str("Sans 9")},
+					want:            testValues{"xsettings/Gtk/FontName": str("Sans 9")},
+					wantGenerations: 1,
+				},
+				{
+					dist: distProfile(`"/Net/ThemeName": "Chicago95", "/Gtk/FontName": "Tahoma 8"`),
+					want: testValues{
+						"xsettings/Net/ThemeName": str("Chicago95"),
+						"xsettings/Gtk/FontName":  str("Tahoma 8"),
+					},
+					wantGenerations: 2,
+				},
+				{
+					dist:            `{"properties": {}}`,
+					want:            testValues{"xsettings/Gtk/FontName": str("Sans 9")},
+					wantGenerations: 3,
+				},
+			},
+		},
+	})
+}
+
+func TestSyncKeepsUserEdits(t *testing.T) {
+	runSyncScenarios(t, []syncScenario{
+		{
+			name:     "properties changed by the user are kept",
+			defaults: testValues{"xsettings/Net/ThemeName": str("Adwaita")},
+			steps: []syncStep{
+				{
+					dist:            distProfile(`"/Net/ThemeName": "Chicago95"`),
+					want:            testValues{"xsettings/Net/ThemeName": str("Chicago95")},
+					wantGenerations: 1,
+				},
+				{
+					dist:            distProfile(`"/Net/ThemeName": "Redmond"`),
+					edits:           testValues{"xsettings/Net/ThemeName": str("Mine")},
+					want:            testValues{"xsettings/Net/ThemeName": str("Mine")},
+					wantGenerations: 2,
+				},
+				{
+					dist:            distProfile(`"/Net/ThemeName": "Luna"`),
+					want:            testValues{"xsettings/Net/ThemeName": str("Mine")},
+					wantGenerations: 3,
+				},
+			},
+		},
+		{
+			name: "properties changed by the user are kept when dropped from the profile",
+			steps: []syncStep{
+				{
+					dist:            distProfile(`"/Net/ThemeName": "Chicago95", "/Net/IconThemeName": "Chicago95"`),
+					want:            testValues{"xsettings/Net/ThemeName": str("Chicago95"), "xsettings/Net/IconThemeName": str("Chicago95")},
+					wantGenerations: 1,
+				},
+				{
+					dist:            distProfile(`"/Net/IconThemeName": "Chicago95"`),
+					edits:           testValues{"xsettings/Net/ThemeName": str("Mine")},
+					want:            testValues{"xsettings/Net/ThemeName": str("Mine"), "xsettings/Net/IconThemeName": str("Chicago95")},
+					wantGenerations: 2,
+				},
+			},
+		},
+	})
+}
+
+func TestSyncHistory(t *testing.T) {
+	runSyncScenarios(t, []syncScenario{
+		{
+			name: "rolling back restores the previous profile until a new one ships",
+			steps: []syncStep{
+				{
+					dist:            distProfile(`"/Net/ThemeName": "Chicago95"`),
+					want:            testValues{"xsettings/Net/ThemeName": str("Chicago95")},
+					wantGenerations: 1,
+				},
+				{
+					dist:            distProfile(`"/Net/ThemeName": "Redmond", "/Net/IconThemeName": "Redmond"`),
+					want:            testValues{"xsettings/Net/ThemeName": str("Redmond"), "xsettings/Net/IconThemeName": str("Redmond")},
+					wantGenerations: 2,
+				},
+				{
+					rollback:        true,
+					want:            testValues{"xsettings/Net/ThemeName": str("Chicago95")},
+					wantGenerations: 3,
+				},
+				{
+					want:            testValues{"xsettings/Net/ThemeName": str("Chicago95")},
+					wantGenerations: 3,
+				},
+				{
+					dist:            distProfile(`"/Net/ThemeName": "Luna"`),
+					want:            testValues{"xsettings/Net/ThemeName": str("Luna")},
+					wantGenerations: 4,
+				},
+			},
+		},
+		{
+			name:    "old generations are pruned",
+			history: 2,
+			steps: []syncStep{
+				{dist: distProfile(`"/Net/ThemeName": "Chicago95"`), want: testValues{"xsettings/Net/ThemeName": str("Chicago95")}, wantGenerations: 1},
+				{dist: distProfile(`"/Net/ThemeName": "Redmond"`), want: testValues{"xsettings/Net/ThemeName": str("Redmond")}, wantGenerations: 2},
+				{dist: distProfile(`"/Net/ThemeName": "Luna"`), want: testValues{"xsettings/Net/ThemeName": str("Luna")}, wantGenerations: 2},
+				{rollback: true, want: testValues{"xsettings/Net/ThemeName": str("Redmond")}, wantGenerations: 2},
+			},
+		},
+	})
+}
+
+func TestSyncDropins(t *testing.T) {
+	runSyncScenarios(t, []syncScenario{
+		{
+			name: "drop-ins are merged over the profile in order",
+			steps: []syncStep{
+				{
+					dist: distProfile(`"/Net/ThemeName": "Chicago95"`),
+					dropins: map[string]string{
+						"20-theme.json": distProfile(`"/Net/ThemeName": "Luna"`),
+						"10-theme.json": distProfile(`"/Net/ThemeName": "Redmond", "/Net/IconThemeName": "Redmond"`),
+					},
+					want:            testValues{"xsettings/Net/ThemeName": str("Luna"), "xsettings/Net/IconThemeName": str("Redmond")},
+					wantGenerations: 1,
+				},
+			},
+		},
+		{
+			name: "changed drop-ins are synced like the profile",
+			steps: []syncStep{
+				{
+					dist: distProfile(`"/Net/ThemeName": "Chicago95"`),
+					dropins: map[string]string{
+						"10-theme.json": distProfile(`"/Net/ThemeName": "Redmond"`),
+						"20-icons.json": distProfile(`"/Net/IconThemeName": "Redmond"`),
+					},
+					want:            testValues{"xsettings/Net/ThemeName": str("Redmond"), "xsettings/Net/IconThemeName": str("Redmond")},
+					wantGenerations: 1,
+				},
+				{
+					dropins:         map[string]string{"20-icons.json": `{"properties": {}}`},
+					want:            testValues{"xsettings/Net/ThemeName": str("Redmond")},
+					wantGenerations: 2,
+				},
+			},
+		},
+	})
+}
+
+func TestSyncOverrides(t *testing.T) {
+	runSyncScenarios(t, []syncScenario{
+		{
+			name: "overrides win over the profile and the user",
+			steps: []syncStep{
+				{
+					dist:            distProfile(`"/Net/ThemeName": "Chicago95"`),
+					want:            testValues{"xsettings/Net/ThemeName": str("Chicago95")},
+					wantGenerations: 1,
+				},
+				{
+					overrides:       distProfile(`"/Net/ThemeName": "Pinned"`),
+					edits:           testValues{"xsettings/Net/ThemeName": str("Mine")},
+					want:            testValues{"xsettings/Net/ThemeName": str("Pinned")},
+					wantGenerations: 2,
+				},
+				{
+					dist:            distProfile(`"/Net/ThemeName": "Redmond"`),
+					want:            testValues{"xsettings/Net/ThemeName": str("Pinned")},
+					wantGenerations: 3,
+				},
+				{
+					overrides:       "-",
+					want:            testValues{"xsettings/Net/ThemeName": str("Redmond")},
+					wantGenerations: 4,
+				},
+			},
+		},
+		{
+			name: "rolling back keeps the overrides",
+			steps: []syncStep{
+				{
+					dist:            distProfile(`"/Net/ThemeName": "Chicago95"`),
+					overrides:       distProfile(`"/Net/IconThemeName": "Pinned"`),
+					want:            testValues{"xsettings/Net/ThemeName": str("Chicago95"), "xsettings/Net/IconThemeName": str("Pinned")},
+					wantGenerations: 1,
+				},
+				{
+					dist:            distProfile(`"/Net/ThemeName": "Redmond", "/Net/IconThemeName": "Redmond"`),
+					want:            testValues{"xsettings/Net/ThemeName": str("Redmond"), "xsettings/Net/IconThemeName": str("Pinned")},
+					wantGenerations: 2,
+				},
+				{
+					rollback:        true,
+					want:            testValues{"xsettings/Net/ThemeName": str("Chicago95"), "xsettings/Net/IconThemeName": str("Pinned")},
+					wantGenerations: 3,
+				},
+			},
+		},
+		{
+			name: "changing the overrides after a rollback keeps the restored profile",
+			steps: []syncStep{
+				{
+					dist:            distProfile(`"/Net/ThemeName": "Chicago95"`),
+					want:            testValues{"xsettings/Net/ThemeName": str("Chicago95")},
+					wantGenerations: 1,
+				},
+				{
+					dist:            distProfile(`"/Net/ThemeName": "Redmond"`),
+					want:            testValues{"xsettings/Net/ThemeName": str("Redmond")},
+					wantGenerations: 2,
+				},
+				{
+					rollback:        true,
+					want:            testValues{"xsettings/Net/ThemeName": str("Chicago95")},
+					wantGenerations: 3,
+				},
+				{
+					overrides:       distProfile(`"/Net/IconThemeName": "Pinned"`),
+					want:            testValues{"xsettings/Net/ThemeName": str("Chicago95"), "xsettings/Net/IconThemeName": str("Pinned")},
+					wantGenerations: 4,
+				},
+				{
+					overrides:       "-",
+					want:            testValues{"xsettings/Net/ThemeName": str("Chicago95")},
+					wantGenerations: 5,
+				},
+			},
+		},
+	})
+}
+
+func TestSyncComparesProperties(t *testing.T) {
+	runSyncScenarios(t, []syncScenario{
+		{
+			name: "formatting and metadata changes make no generation",
+			steps: []syncStep{
+				{
+					dist:            distProfile(`"/Net/ThemeName": "Chicago95", "/Net/IconThemeName": "Chicago95"`),
+					want:            testValues{"xsettings/Net/ThemeName": str("Chicago95"), "xsettings/Net/IconThemeName": str("Chicago95")},
+					wantGenerations: 1,
+				},
+				{
+					dist: `{
+						"metadata": {"version": 2},
+						"properties": {"xsettings": {"/Net/IconThemeName": "Chicago95", "/Net/ThemeName": "Chicago95"}}
+					}`,
+					edits:           testValues{"xsettings/Net/ThemeName": str("Mine")},
+					want:            testValues{"xsettings/Net/ThemeName": str("Mine"), "xsettings/Net/IconThemeName": str("Chicago95")},
+					wantGenerations: 1,
+				},
+			},
+		},
+		{
+			name: "values written differently are the same value",
+			steps: []syncStep{
+				{
+					dist:            `{"properties": {"xfwm4": {"/general/workspace_count": 4}}}`,
+					want:            testValues{"xfwm4/general/workspace_count": {Type: "int", Value: "4"}},
+					wantGenerations: 1,
+				},
+				{
+					dist:            `{"properties": {"xfwm4": {"/general/workspace_count": {"type": "int", "value": 4}}}}`,
+					want:            testValues{"xfwm4/general/workspace_count": {Type: "int", Value: "4"}},
+					wantGenerations: 1,
+				},
+			},
+		},
+	})
+}
+
+// Run a function and return what it printed
+func captureOutput(t *testing.T, run func()) string {
+	t.Helper()
+
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = writer
+	defer func() { os.Stdout = stdout }()
+
+	output := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(reader)
+		output <- string(data)
+	}()
+
+	run()
+	writer.Close()
+	return <-output
+}
+
+// Every file below a directory along with its contents
+func readTree(t *testing.T, dir string) map[string]string {
+	t.Helper()
+
+	files := make(map[string]string)
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		files[path] = string(data)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestSyncDryRun(t *testing.T) {
+	tests := []struct {
+		name     string
+		defaults testValues
+		// Syncs made before the dry run
+		before []syncStep
+		// The change the dry run previews
+		next syncStep
+	}{
+		{
+			name: "first sync",
+			next: syncStep{
+				dist:      distProfile(`"/Net/ThemeName": "Chicago95", "/Net/IconThemeName": "Chicago95"`),
+				overrides: distProfile(`"/Net/IconThemeName": "Pinned"`),
+			},
+		},
+		{
+			name:     "new version with user edits",
+			defaults: testValues{"xsettings/Net/ThemeName": str("Adwaita")},
+			before: []syncStep{
+				{dist: distProfile(`"/Net/ThemeName": "Chicago95", "/Net/IconThemeName": "Chicago95", "/Gtk/FontName": "Tahoma 8"`)},
+			},
+			next: syncStep{
+				dist:  distProfile(`"/Net/ThemeName": "Redmond", "/Net/IconThemeName": "Redmond"`),
+				edits: testValues{"xsettings/Net/IconThemeName": str("Mine")},
+			},
+		},
+		{
+			name:     "overrides removed",
+			defaults: testValues{"xsettings/Net/ThemeName": str("Adwaita")},
+			before: []syncStep{
+				{
+					dist:      distProfile(`"/Net/ThemeName": "Chicago95"`),
+					overrides: distProfile(`"/Net/ThemeName": "Pinned"`),
+				},
+			},
+			next: syncStep{
+				dist:      distProfile(`"/Net/ThemeName": "Redmond"`),
+				overrides: "-",
+			},
+		},
+		{
+			name:     "rollback",
+			defaults: testValues{"xsettings/Net/ThemeName": str("Adwaita")},
+			before: []syncStep{
+				{dist: distProfile(`"/Net/ThemeName": "Chicago95"`)},
+				{dist: distProfile(`"/Net/ThemeName": "Redmond", "/Net/IconThemeName": "Redmond"`)},
+			},
+			next: syncStep{rollback: true},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			env := newSyncEnv(t, test.defaults, 0)
+			for _, step := range test.before {
+				env.prepare(t, step)
+				if err := env.run(step, false); err != nil {
+					t.Fatal(err)
+				}
+			}
+			env.prepare(t, test.next)
+
+			stateHome := os.Getenv("XDG_STATE_HOME")
+			state := readTree(t, stateHome)
+			properties := make(testValues)
+			for channel, values := range env.backend.Properties {
+				for property, value := range values {
+					properties[channel+property] = value
+				}
+			}
+
+			var err error
+			report := captureOutput(t, func() { err = env.run(test.next, true) })
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			assertProperties(t, env.backend, properties)
+			if !maps.Equal(readTree(t, stateHome), state) {
+				t.Error("the dry run changed the state directory")
+			}
+
+			// Apart from saying so, the dry run reports exactly what the sync does
+			output := captureOutput(t, func() { err = env.run(test.next, false) })
+			if err != nil {
+				t.Fatal(err)
+			}
+			report = strings.ReplaceAll(report, " (skipping due to dry run)", "")
+			report = strings.Replace(report, "Dry run -- the state directory is left unchanged\n", "", 1)
+			if report != output {
+				t.Errorf("the dry run reported\n%s\nbut the sync did\n%s", report, output)
+			}
+		})
+	}
+}
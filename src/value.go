@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Value is a property value along with the xfconf type it should be stored as. Arrays have the
+// type "array" and hold their elements in Items. Values read back from xfconf-query have an empty
+// type when it could not be determined.
+type Value struct {
+	Type  string
+	Value string
+	Items []Value
+}
+
+// Action is what a profile entry does to its property
+type Action string
+
+const (
+	// Set the property to the entry's value
+	ActionSet Action = "set"
+	// Reset the property to its default value
+	ActionReset Action = "reset"
+	// Reset the property and every property below it
+	ActionRemove Action = "remove"
+)
+
+// Entry is a single property of a profile
+type Entry struct {
+	Action Action
+	Value  Value
+}
+
+// The entry as written in a profile
+func (e Entry) profileValue() any {
+	switch e.Action {
+	case ActionReset:
+		return nil
+	case ActionRemove:
+		return map[string]any{"action": string(ActionRemove)}
+	default:
+		return e.Value.profileValue()
+	}
+}
+
+// Types that can be passed to xfconf-query --type
+var scalarTypes = map[string]bool{
+	"string": true,
+	"bool":   true,
+	"int":    true,
+	"uint":   true,
+	"int64":  true,
+	"uint64": true,
+	"int16":  true,
+	"uint16": true,
+	"char":   true,
+	"uchar":  true,
+	"float":  true,
+	"double": true,
+}
+
+func isNumericType(typeName string) bool {
+	return scalarTypes[typeName] && typeName != "string" && typeName != "bool"
+}
+
+// Check that a textual value can be stored as the given xfconf type
+func validateScalar(typeName string, value string) error {
+	var err error
+	switch typeName {
+	case "string":
+	case "bool":
+		_, err = strconv.ParseBool(value)
+	case "int":
+		_, err = strconv.ParseInt(value, 10, 32)
+	case "uint":
+		_, err = strconv.ParseUint(value, 10, 32)
+	case "int64":
+		_, err = strconv.ParseInt(value, 10, 64)
+	case "uint64":
+		_, err = strconv.ParseUint(value, 10, 64)
+	case "int16":
+		_, err = strconv.ParseInt(value, 10, 16)
+	case "uint16":
+		_, err = strconv.ParseUint(value, 10, 16)
+	case "char":
+		_, err = strconv.ParseInt(value, 10, 8)
+	case "uchar":
+		_, err = strconv.ParseUint(value, 10, 8)
+	case "float":
+		_, err = strconv.ParseFloat(value, 32)
+	case "double":
+		_, err = strconv.ParseFloat(value, 64)
+	default:
+		return fmt.Errorf("unsupported xfconf type %q", typeName)
+	}
+	if err != nil {
+		return fmt.Errorf("%q is not a valid %s", value, typeName)
+	}
+	return nil
+}
+
+// Convert a property decoded from a profile into an entry. Besides values, an entry can be null to
+// reset the property, or a directive object such as {"action": "remove"}.
+func parseProfileEntry(raw any, typeHint string) (Entry, error) {
+	if raw == nil {
+		return Entry{Action: ActionReset}, nil
+	}
+
+	if object, ok := raw.(map[string]any); ok {
+		if action, ok := object["action"]; ok {
+			return parseDirective(object, action)
+		}
+	}
+
+	value, err := parseProfileValue(raw, typeHint)
+	if err != nil {
+		return Entry{}, err
+	}
+	return Entry{Action: ActionSet, Value: value}, nil
+}
+
+// Parse a directive object such as {"action": "reset"}
+func parseDirective(object map[string]any, action any) (Entry, error) {
+	if len(object) != 1 {
+		return Entry{}, fmt.Errorf("directive must only have an \"action\" key")
+	}
+
+	switch action {
+	case string(ActionReset):
+		return Entry{Action: ActionReset}, nil
+	case string(ActionRemove):
+		return Entry{Action: ActionRemove}, nil
+	default:
+		return Entry{}, fmt.Errorf("unknown action %v: must be 'reset' or 'remove'", action)
+	}
+}
+
+// Convert a value decoded from a profile into a typed xfconf value. The type hint is the
+// property's existing or default type (or the type of its elements for arrays), if known, and is
+// used to pick the type for JSON numbers.
+func parseProfileValue(raw any, typeHint string) (Value, error) {
+	if items, ok := raw.([]any); ok {
+		return parseArray(items, typeHint)
+	}
+
+	return parseScalar(raw, typeHint)
+}
+
+// Parse an array whose elements are each a bare or typed scalar
+func parseArray(items []any, typeHint string) (Value, error) {
+	array := Value{Type: "array", Items: []Value{}}
+
+	for i, item := range items {
+		element, err := parseScalar(item, typeHint)
+		if err != nil {
+			return Value{}, fmt.Errorf("array element %d: %v", i, err)
+		}
+		array.Items = append(array.Items, element)
+	}
+
+	return array, nil
+}
+
+func parseScalar(raw any, typeHint string) (Value, error) {
+	switch v := raw.(type) {
+	case string:
+		return Value{Type: "string", Value: v}, nil
+	case bool:
+		return Value{Type: "bool", Value: strconv.FormatBool(v)}, nil
+	case json.Number:
+		return parseNumber(v, typeHint), nil
+	case map[string]any:
+		return parseTypedValue(v)
+	default:
+		return Value{}, fmt.Errorf("unsupported value type %T", raw)
+	}
+}
+
+// Parse an explicitly typed value such as {"type": "uint", "value": 3}
+func parseTypedValue(object map[string]any) (Value, error) {
+	typeName, ok := object["type"].(string)
+	if !ok {
+		return Value{}, fmt.Errorf("typed value requires a \"type\" string")
+	}
+	if !scalarTypes[typeName] {
+		return Value{}, fmt.Errorf("unsupported xfconf type %q", typeName)
+	}
+
+	raw, ok := object["value"]
+	if !ok {
+		return Value{}, fmt.Errorf("typed value requires a \"value\"")
+	}
+
+	for key := range object {
+		if key != "type" && key != "value" {
+			return Value{}, fmt.Errorf("unknown key %q in typed value", key)
+		}
+	}
+
+	var text string
+	switch v := raw.(type) {
+	case string:
+		text = v
+	case bool:
+		text = strconv.FormatBool(v)
+	case json.Number:
+		text = v.String()
+	default:
+		return Value{}, fmt.Errorf("unsupported value type %T for typed value", raw)
+	}
+
+	if err := validateScalar(typeName, text); err != nil {
+		return Value{}, err
+	}
+
+	return Value{Type: typeName, Value: text}, nil
+}
+
+// JSON numbers do not say which of xfconf's numeric types they are. Prefer the type hint when the
+// number fits in it, otherwise guess from the number itself.
+func parseNumber(number json.Number, typeHint string) Value {
+	text := number.String()
+
+	if isNumericType(typeHint) && validateScalar(typeHint, text) == nil {
+		return Value{Type: typeHint, Value: text}
+	}
+
+	for _, guess := range []string{"int", "int64", "uint64"} {
+		if validateScalar(guess, text) == nil {
+			return Value{Type: guess, Value: text}
+		}
+	}
+
+	return Value{Type: "double", Value: text}
+}
+
+// Arguments for xfconf-query that set this value
+func (v Value) queryArgs() ([]string, error) {
+	if v.Type != "array" {
+		return []string{"--type", v.Type, "--set", v.Value}, nil
+	}
+
+	if len(v.Items) == 0 {
+		return nil, fmt.Errorf("xfconf-query cannot set an empty array")
+	}
+
+	args := []string{"--force-array"}
+	for _, item := range v.Items {
+		args = append(args, "--type", item.Type, "--set", item.Value)
+	}
+	return args, nil
+}
+
+// Parse the text xfconf-query prints when querying a property. xfconf-query does not print types,
+// so the value and its array elements are left untyped.
+func parseQueryOutput(output string) Value {
+	if !strings.HasPrefix(output, "Value is an array with ") {
+		return Value{Value: output}
+	}
+
+	array := Value{Type: "array", Items: []Value{}}
+
+	// The item count is followed by a blank line and then one item per line
+	lines := strings.Split(output, "\n")
+	if len(lines) > 2 {
+		for _, line := range lines[2:] {
+			array.Items = append(array.Items, Value{Value: line})
+		}
+	}
+
+	return array
+}
+
+// Fill in missing types from another value of the same property, such as one read from XML
+func (v Value) withTypesFrom(typed Value) Value {
+	if v.Type == "" && typed.Type != "array" {
+		v.Type = typed.Type
+	}
+
+	if v.Type == "array" && typed.Type == "array" && len(v.Items) == len(typed.Items) {
+		items := make([]Value, len(v.Items))
+		for i, item := range v.Items {
+			items[i] = item.withTypesFrom(typed.Items[i])
+		}
+		v.Items = items
+	}
+
+	return v
+}
+
+// The type used to interpret JSON numbers set on a property holding this value: the value's
+// own type, or the type of its elements for arrays.
+func (v Value) typeHint() string {
+	if v.Type != "array" {
+		return v.Type
+	}
+	if len(v.Items) == 0 {
+		return ""
+	}
+	return v.Items[0].Type
+}
+
+// Equal compares values the way xfconf-query would print them, which allows comparing values
+// whose type is unknown with typed ones. Values whose types are both known must have the same type.
+func (v Value) Equal(other Value) bool {
+	if v.Type != "" && other.Type != "" && v.Type != other.Type {
+		return false
+	}
+
+	if v.Type == "array" && other.Type == "array" {
+		if len(v.Items) != len(other.Items) {
+			return false
+		}
+		for i := range v.Items {
+			if !v.Items[i].Equal(other.Items[i]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	return v.queryOutput() == other.queryOutput()
+}
+
+// The value as written in a profile. Typed values are written as typed value objects so that
+// they are read back with the same type.
+func (v Value) profileValue() any {
+	switch v.Type {
+	case "array":
+		items := make([]any, len(v.Items))
+		for i, item := range v.Items {
+			items[i] = item.profileValue()
+		}
+		return items
+	case "":
+		return v.Value
+	default:
+		return map[string]any{"type": v.Type, "value": v.Value}
+	}
+}
+
+// The text xfconf-query prints when querying a property holding this value
+func (v Value) queryOutput() string {
+	switch v.Type {
+	case "array":
+		lines := []string{fmt.Sprintf("Value is an array with %d items:\n", len(v.Items))}
+		for _, item := range v.Items {
+			lines = append(lines, item.queryOutput())
+		}
+		return strings.Join(lines, "\n")
+	case "double", "float":
+		number, err := strconv.ParseFloat(v.Value, 64)
+		if err != nil {
+			return v.Value
+		}
+		return fmt.Sprintf("%f", number)
+	default:
+		return v.Value
+	}
+}
+
+func (v Value) String() string {
+	if v.Type != "array" {
+		return v.Value
+	}
+
+	items := make([]string, len(v.Items))
+	for i, item := range v.Items {
+		items[i] = item.Value
+	}
+	return "[" + strings.Join(items, ", ") + "]"
+}
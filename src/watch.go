@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/godbus/dbus/v5"
+)
+
+// PropertyChange is a change to a property seen while recording
+type PropertyChange struct {
+	Channel  string
+	Property string
+	Value    Value
+	// The property was removed, which resets it to its default value
+	Removed bool
+}
+
+// ChangeWatcher reports changes to properties as they happen
+type ChangeWatcher interface {
+	// Changes delivers the changes in batches. It is closed when watching stops, after which Err
+	// tells why.
+	Changes() <-chan []PropertyChange
+	Err() error
+	// Close stops watching
+	Close() error
+}
+
+// Open a watcher of the given kind on the user's session. xfconfd is watched over D-Bus if it can
+// be reached, and the perchannel XML files are watched otherwise.
+func openChangeWatcher(kind string) (ChangeWatcher, error) {
+	switch kind {
+	case BackendAuto:
+		bus, err := ConnectXfconfDBus()
+		if err != nil {
+			logger.Debug("Falling back to XML files", "reason", err)
+			return WatchXfconfXML(perchannelDir(xdgConfigHome()))
+		}
+		return WatchXfconfDBus(bus.conn)
+	case BackendDBus:
+		bus, err := ConnectXfconfDBus()
+		if err != nil {
+			return nil, err
+		}
+		return WatchXfconfDBus(bus.conn)
+	case BackendXML:
+		return WatchXfconfXML(perchannelDir(xdgConfigHome()))
+	default:
+		return nil, fmt.Errorf("invalid backend: must be '%s', '%s' or '%s'", BackendAuto, BackendDBus, BackendXML)
+	}
+}
+
+// XMLWatcher watches the perchannel XML files. xfconfd rewrites a channel's file whenever one of
+// its properties changes, so watching the directory tells which channel to read again without
+// polling all of them. xfconfd writes the files lazily, so changes may show up late.
+type XMLWatcher struct {
+	dir     string
+	xfconf  *Xfconf
+	watcher *fsnotify.Watcher
+	changes chan []PropertyChange
+	err     error
+}
+
+func WatchXfconfXML(dir string) (*XMLWatcher, error) {
+	xfconf, err := newXfconfFromDirs(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read xfconf settings: %v", err)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", dir, err)
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch %s: %v", dir, err)
+	}
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("failed to watch %s: %v", dir, err)
+	}
+
+	w := &XMLWatcher{
+		dir:     dir,
+		xfconf:  xfconf,
+		watcher: watcher,
+		changes: make(chan []PropertyChange),
+	}
+	go w.run()
+	return w, nil
+}
+
+func (w *XMLWatcher) run() {
+	defer close(w.changes)
+
+	for {
+		select {
+		case err, ok := <-w.watcher.Errors:
+			if ok {
+				w.err = fmt.Errorf("failed to watch %s: %v", w.dir, err)
+			}
+			return
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Ext(event.Name) != ".xml" || event.Has(fsnotify.Chmod) {
+				continue
+			}
+
+			changed, removed, err := w.xfconf.ReloadChannel(event.Name)
+			if err != nil {
+				// The file may be caught halfway through being written, and is read again once
+				// the write is finished
+				logger.Debug("Failed to read channel", "file", event.Name, "error", err)
+				continue
+			}
+			if len(changed) == 0 && len(removed) == 0 {
+				continue
+			}
+
+			var changes []PropertyChange
+			for _, item := range changed {
+				changes = append(changes, PropertyChange{Channel: item.Channel, Property: item.PropertyPath, Value: item.Value()})
+			}
+			for _, item := range removed {
+				changes = append(changes, PropertyChange{Channel: item.Channel, Property: item.PropertyPath, Removed: true})
+			}
+			w.changes <- changes
+		}
+	}
+}
+
+func (w *XMLWatcher) Changes() <-chan []PropertyChange {
+	return w.changes
+}
+
+func (w *XMLWatcher) Err() error {
+	return w.err
+}
+
+func (w *XMLWatcher) Close() error {
+	return w.watcher.Close()
+}
+
+// DBusWatcher listens to the signals xfconfd emits when a property changes. Unlike the XML files,
+// these are sent the moment a change happens and carry the property's type.
+type DBusWatcher struct {
+	conn    *dbus.Conn
+	signals chan *dbus.Signal
+	changes chan []PropertyChange
+	err     error
+}
+
+// WatchXfconfDBus listens for xfconfd's signals on an existing connection, which allows pointing
+// it at any bus. Closing the watcher closes the connection.
+func WatchXfconfDBus(conn *dbus.Conn) (*DBusWatcher, error) {
+	err := conn.AddMatchSignal(
+		dbus.WithMatchObjectPath(xfconfObjectPath),
+		dbus.WithMatchInterface(xfconfInterface),
+	)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to listen for xfconfd's signals: %v", err)
+	}
+
+	w := &DBusWatcher{
+		conn:    conn,
+		signals: make(chan *dbus.Signal, 64),
+		changes: make(chan []PropertyChange),
+	}
+	conn.Signal(w.signals)
+	go w.run()
+	return w, nil
+}
+
+func (w *DBusWatcher) run() {
+	defer close(w.changes)
+
+	// The signal channel is closed along with the connection
+	defer func() {
+		w.err = errors.New("the connection to xfconfd was closed")
+	}()
+
+	for signal := range w.signals {
+		change, ok, err := changeFromSignal(signal)
+		if err != nil {
+			logger.Warn("Ignoring signal", "signal", signal.Name, "error", err)
+			continue
+		}
+		if ok {
+			w.changes <- []PropertyChange{change}
+		}
+	}
+}
+
+// Convert one of xfconfd's PropertyChanged and PropertyRemoved signals to a change. Other signals
+// are ignored.
+func changeFromSignal(signal *dbus.Signal) (PropertyChange, bool, error) {
+	var change PropertyChange
+
+	switch signal.Name {
+	case xfconfInterface + ".PropertyChanged":
+		var variant dbus.Variant
+		if err := dbus.Store(signal.Body, &change.Channel, &change.Property, &variant); err != nil {
+			return change, false, err
+		}
+		value, err := valueFromVariant(variant)
+		if err != nil {
+			return change, false, fmt.Errorf("failed to read %s%s: %v", change.Channel, change.Property, err)
+		}
+		change.Value = value
+		return change, true, nil
+	case xfconfInterface + ".PropertyRemoved":
+		if err := dbus.Store(signal.Body, &change.Channel, &change.Property); err != nil {
+			return change, false, err
+		}
+		change.Removed = true
+		return change, true, nil
+	default:
+		return change, false, nil
+	}
+}
+
+func (w *DBusWatcher) Changes() <-chan []PropertyChange {
+	return w.changes
+}
+
+func (w *DBusWatcher) Err() error {
+	return w.err
+}
+
+func (w *DBusWatcher) Close() error {
+	return w.conn.Close()
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// Wait for the next batch of changes from a watcher
+func nextChanges(t *testing.T, watcher ChangeWatcher) []PropertyChange {
+	t.Helper()
+
+	select {
+	case changes, ok := <-watcher.Changes():
+		if !ok {
+			t.Fatalf("watcher stopped: %v", watcher.Err())
+		}
+		return changes
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for changes")
+		return nil
+	}
+}
+
+func sameChange(a, b PropertyChange) bool {
+	return a.Channel == b.Channel && a.Property == b.Property && a.Removed == b.Removed &&
+		a.Value.Type == b.Value.Type && a.Value.Equal(b.Value)
+}
+
+func TestDBusWatcher(t *testing.T) {
+	address := startTestBus(t)
+	emitter := connectTestBus(t, address)
+
+	conn, err := dbus.Connect(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	watcher, err := WatchXfconfDBus(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+
+	tests := []struct {
+		name   string
+		member string
+		args   []any
+		want   PropertyChange
+	}{
+		{
+			name:   "string",
+			member: "PropertyChanged",
+			args:   []any{"xfwm4", "/general/theme", dbus.MakeVariant("Chicago95")},
+			want:   PropertyChange{Channel: "xfwm4", Property: "/general/theme", Value: Value{Type: "string", Value: "Chicago95"}},
+		},
+		{
+			name:   "uint",
+			member: "PropertyChanged",
+			args:   []any{"xfce4-panel", "/panels/panel-1/size", dbus.MakeVariant(uint32(28))},
+			want:   PropertyChange{Channel: "xfce4-panel", Property: "/panels/panel-1/size", Value: Value{Type: "uint", Value: "28"}},
+		},
+		{
+			name:   "array",
+			member: "PropertyChanged",
+			args: []any{"xfce4-panel", "/panels", dbus.MakeVariant([]dbus.Variant{
+				dbus.MakeVariant(int32(1)),
+				dbus.MakeVariant(int32(2)),
+			})},
+			want: PropertyChange{Channel: "xfce4-panel", Property: "/panels", Value: Value{Type: "array", Items: []Value{
+				{Type: "int", Value: "1"},
+				{Type: "int", Value: "2"},
+			}}},
+		},
+		{
+			name:   "removed",
+			member: "PropertyRemoved",
+			args:   []any{"xfce4-panel", "/plugins/plugin-12"},
+			want:   PropertyChange{Channel: "xfce4-panel", Property: "/plugins/plugin-12", Removed: true},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// Other signals of the interface are ignored
+			if err := emitter.Emit(xfconfObjectPath, xfconfInterface+".Unrelated", "xfwm4"); err != nil {
+				t.Fatal(err)
+			}
+			if err := emitter.Emit(xfconfObjectPath, xfconfInterface+"."+test.member, test.args...); err != nil {
+				t.Fatal(err)
+			}
+
+			changes := nextChanges(t, watcher)
+			if len(changes) != 1 || !sameChange(changes[0], test.want) {
+				t.Errorf("got %+v, want %+v", changes, test.want)
+			}
+		})
+	}
+
+	// Losing the connection stops the watcher
+	conn.Close()
+	select {
+	case _, ok := <-watcher.Changes():
+		if ok {
+			t.Fatal("got changes after the connection was closed")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher did not stop after the connection was closed")
+	}
+	if watcher.Err() == nil {
+		t.Error("watcher stopped without an error")
+	}
+}
+
+func TestXMLWatcher(t *testing.T) {
+	dir := t.TempDir()
+	write := func(content string) {
+		t.Helper()
+		// Like xfconfd, replace the file instead of writing it in place
+		path := filepath.Join(dir, "xfwm4.xml")
+		if err := os.WriteFile(path+".new", []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(path+".new", path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write(`<?xml version="1.0" encoding="UTF-8"?>
+<channel name="xfwm4" version="1.0">
+  <property name="general" type="empty">
+    <property name="theme" type="string" value="Default"/>
+    <property name="title_font" type="string" value="Sans Bold 9"/>
+  </property>
+</channel>
+`)
+
+	watcher, err := WatchXfconfXML(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer watcher.Close()
+
+	write(`<?xml version="1.0" encoding="UTF-8"?>
+<channel name="xfwm4" version="1.0">
+  <property name="general" type="empty">
+    <property name="theme" type="string" value="Chicago95"/>
+    <property name="workspace_count" type="int" value="2"/>
+  </property>
+</channel>
+`)
+
+	want := []PropertyChange{
+		{Channel: "xfwm4", Property: "/general/theme", Value: Value{Type: "string", Value: "Chicago95"}},
+		{Channel: "xfwm4", Property: "/general/workspace_count", Value: Value{Type: "int", Value: "2"}},
+		{Channel: "xfwm4", Property: "/general/title_font", Removed: true},
+	}
+	changes := nextChanges(t, watcher)
+	if len(changes) != len(want) {
+		t.Fatalf("got %+v, want %+v", changes, want)
+	}
+	for i := range want {
+		if !sameChange(changes[i], want[i]) {
+			t.Errorf("change %d is %+v, want %+v", i, changes[i], want[i])
+		}
+	}
+}
+
+// fakeWatcher reports the changes sent to it, and fails with err once closed
+type fakeWatcher struct {
+	changes chan []PropertyChange
+	err     error
+}
+
+func (w *fakeWatcher) Changes() <-chan []PropertyChange {
+	return w.changes
+}
+
+func (w *fakeWatcher) Err() error {
+	return w.err
+}
+
+func (w *fakeWatcher) Close() error {
+	return nil
+}
+
+func TestRecordKeepsChangesWhenWatchingFails(t *testing.T) {
+	watcher := &fakeWatcher{
+		changes: make(chan []PropertyChange, 1),
+		err:     errors.New("the connection to xfconfd was closed"),
+	}
+	watcher.changes <- []PropertyChange{
+		{Channel: "xfwm4", Property: "/general/theme", Value: Value{Type: "string", Value: "Chicago95"}},
+	}
+	close(watcher.changes)
+
+	output := filepath.Join(t.TempDir(), "recorded.json")
+	err := recordChanges(watcher, RecordFilter{}, 0, RecordFormatProfile, output, "", "")
+	if err != watcher.err {
+		t.Errorf("got error %v, want %v", err, watcher.err)
+	}
+
+	recorded, err := loadProfile(output)
+	if err != nil {
+		t.Fatalf("nothing was recorded: %v", err)
+	}
+	if got := recorded.Properties["xfwm4"]["/general/theme"]; got != "Chicago95" {
+		t.Errorf("recorded /general/theme as %v", got)
+	}
+}
+
+func TestRecordStopsAfterDuration(t *testing.T) {
+	watcher := &fakeWatcher{changes: make(chan []PropertyChange, 1)}
+	watcher.changes <- []PropertyChange{
+		{Channel: "xfwm4", Property: "/general/theme", Value: Value{Type: "string", Value: "Chicago95"}},
+		{Channel: "xfwm4", Property: "/general/title_font", Removed: true},
+		{Channel: "thunar", Property: "/last-window-width", Value: Value{Type: "int", Value: "640"}},
+	}
+
+	filter, err := newRecordFilter([]string{"xfwm4"}, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The watcher is never closed, so only the duration stops recording
+	output := filepath.Join(t.TempDir(), "recorded.json")
+	done := make(chan error)
+	go func() {
+		done <- recordChanges(watcher, filter, 100*time.Millisecond, RecordFormatProfile, output, "", "")
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("recording did not stop after its duration")
+	}
+
+	recorded := loadTestProfile(t, output)
+	want := Properties{"xfwm4": {"/general/theme": "Chicago95", "/general/title_font": nil}}
+	if !reflect.DeepEqual(recorded.Properties, want) {
+		t.Errorf("recorded %v, want %v", recorded.Properties, want)
+	}
+}
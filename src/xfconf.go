@@ -7,13 +7,13 @@ package main
 
 import (
 	"encoding/xml"
+	"errors"
 	"fmt"
-	"github.com/fatih/color"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
-	"time"
 )
 
 type Xfconf struct {
@@ -31,72 +31,133 @@ type Property struct {
 	Name     string     `xml:"name,attr"`
 	Type     string     `xml:"type,attr"`
 	Value    string     `xml:"value,attr"`
+	Locked   string     `xml:"locked,attr,omitempty"`
+	Values   []Property `xml:"value"`
 	Property []Property `xml:"property"`
 }
 
 func NewXfconf() (*Xfconf, error) {
+	return newXfconfFromDirs(perchannelDir(xdgConfigHome()))
+}
+
+// newXfconfFromDirs parses every perchannel XML file in the given directories. Properties found
+// in later directories override the ones found in earlier directories.
+func newXfconfFromDirs(dirsXfconf ...string) (*Xfconf, error) {
 	xfconf := &Xfconf{
 		xfconfItems: make(map[string]XfconfItem),
 	}
 
-	// TODO: check XDG_CONFIG_DIR here
-	dirXfconf := filepath.Join(os.Getenv("HOME"), ".config", "xfce4", "xfconf", "xfce-perchannel-xml")
-	files, err := filepath.Glob(filepath.Join(dirXfconf, "*.xml"))
-	if err != nil {
-		return nil, err
-	}
-
-	for _, xmlFile := range files {
-		if err := xfconf.parseXfconfPerchannelXML(xmlFile); err != nil {
+	for _, dirXfconf := range dirsXfconf {
+		files, err := filepath.Glob(filepath.Join(dirXfconf, "*.xml"))
+		if err != nil {
 			return nil, err
 		}
+
+		for _, xmlFile := range files {
+			if err := xfconf.parseXfconfPerchannelXML(xmlFile); err != nil {
+				return nil, err
+			}
+		}
 	}
 
 	return xfconf, nil
 }
 
-// Diff returns the settings that have been changed.
-func (xfconf *Xfconf) Diff() ([]string, error) {
+// ReloadChannel re-reads a single perchannel XML file and returns the properties of its channel
+// that have been set or changed, and the ones that have been removed. A missing file is read as an
+// empty channel.
+func (xfconf *Xfconf) ReloadChannel(xmlFile string) ([]XfconfItem, []XfconfItem, error) {
+	channel := strings.TrimSuffix(filepath.Base(xmlFile), ".xml")
 
-	newXfconf, err := NewXfconf()
-	if err != nil {
-		return nil, err
+	newXfconf := &Xfconf{
+		xfconfItems: make(map[string]XfconfItem),
+	}
+	if err := newXfconf.parseXfconfPerchannelXML(xmlFile); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, nil, err
 	}
 
-	before := xfconf.String()
-	after := newXfconf.String()
+	var changes []XfconfItem
+	for key, item := range newXfconf.xfconfItems {
+		previous, ok := xfconf.xfconfItems[key]
+		if !ok || !previous.Value().Equal(item.Value()) {
+			changes = append(changes, item)
+		}
+	}
 
-	xfconf.xfconfItems = newXfconf.xfconfItems
+	var removed []XfconfItem
+	for key, item := range xfconf.xfconfItems {
+		if item.Channel != channel {
+			continue
+		}
+		if _, ok := newXfconf.xfconfItems[key]; !ok {
+			removed = append(removed, item)
+		}
+		delete(xfconf.xfconfItems, key)
+	}
+	for key, item := range newXfconf.xfconfItems {
+		xfconf.xfconfItems[key] = item
+	}
 
-	return diffStrings(before, after), nil
+	byPath := func(a, b XfconfItem) int {
+		return strings.Compare(a.PropertyPath, b.PropertyPath)
+	}
+	slices.SortFunc(changes, byPath)
+	slices.SortFunc(removed, byPath)
+	return changes, removed, nil
 }
 
-// String returns the string representation of the Xfconf settings.
-func (xfconf *Xfconf) String() string {
-	var commands []string
-	for _, item := range xfconf.xfconfItems {
-		cmd := fmt.Sprintf("xfconf-query --create -c %s -p %s",
-			quoteCommand(item.Channel),
-			quoteCommand(item.PropertyPath))
-
-		if item.PropertyType == "array" {
-			for _, arrayItem := range item.PropertyValue.([]interface{}) {
-				arrayItemType := arrayItem.(map[string]interface{})["type"].(string)
-				arrayItemValue := arrayItem.(map[string]interface{})["value"].(string)
-				cmd += fmt.Sprintf(" --type %s --set %s",
-					quoteCommand(arrayItemType),
-					quoteCommand(arrayItemValue))
-			}
+// Value returns the value of a property and whether it is set.
+func (xfconf *Xfconf) Value(channel, property string) (Value, bool) {
+	item, ok := xfconf.xfconfItems[channel+property]
+	if !ok {
+		return Value{}, false
+	}
+	return item.Value(), true
+}
+
+// Value converts the item to a typed value.
+func (item XfconfItem) Value() Value {
+	if item.PropertyType != "array" {
+		return Value{Type: item.PropertyType, Value: fmt.Sprintf("%v", item.PropertyValue)}
+	}
+
+	array := Value{Type: "array", Items: []Value{}}
+	for _, arrayItem := range item.PropertyValue.([]interface{}) {
+		array.Items = append(array.Items, Value{
+			Type:  arrayItem.(map[string]interface{})["type"].(string),
+			Value: arrayItem.(map[string]interface{})["value"].(string),
+		})
+	}
+	return array
+}
+
+// queryCommand returns the xfconf-query command setting a property to a value.
+func queryCommand(channel, property string, value Value) (string, error) {
+	args, err := value.queryArgs()
+	if err != nil {
+		return "", err
+	}
+
+	cmd := fmt.Sprintf("xfconf-query --create -c %s -p %s",
+		quoteCommand(channel),
+		quoteCommand(property))
+	// Quote the operands of the options, which come from the value
+	isOperand := false
+	for _, arg := range args {
+		if isOperand {
+			cmd += " " + quoteCommand(arg)
 		} else {
-			cmd += fmt.Sprintf(" --type %s --set %s",
-				quoteCommand(item.PropertyType),
-				quoteCommand(fmt.Sprintf("%v", item.PropertyValue)))
+			cmd += " " + arg
 		}
-
-		commands = append(commands, cmd)
+		isOperand = !isOperand && (arg == "--type" || arg == "--set")
 	}
 
-	return strings.Join(commands, "\n")
+	return cmd, nil
+}
+
+// resetCommand returns the xfconf-query command resetting a property.
+func resetCommand(channel, property string) string {
+	return fmt.Sprintf("xfconf-query -c %s -p %s --reset", quoteCommand(channel), quoteCommand(property))
 }
 
 // parseXfconfPerchannelXML parses the Xfconf XML file.
@@ -128,17 +189,21 @@ func (xfconf *Xfconf) parseXfconfPerchannelXML(xmlFile string) error {
 // parseProperty parses a single property.
 func (xfconf *Xfconf) parseProperty(prop Property, channelName, propertyPath string) {
 	curPropertyPath := propertyPath + "/" + prop.Name
+
+	// Properties of any type can have child properties
+	for _, subProp := range prop.Property {
+		xfconf.parseProperty(subProp, channelName, curPropertyPath)
+	}
+
 	if prop.Type == "empty" {
-		for _, subProp := range prop.Property {
-			xfconf.parseProperty(subProp, channelName, curPropertyPath)
-		}
 		return
 	}
 
 	var propertyValue interface{}
 	if prop.Type == "array" {
+		// Array elements are stored as <value> elements
 		var arrayItems []interface{}
-		for _, arrayItem := range prop.Property {
+		for _, arrayItem := range prop.Values {
 			arrayItems = append(arrayItems, map[string]interface{}{
 				"type":  arrayItem.Type,
 				"value": arrayItem.Value,
@@ -149,7 +214,7 @@ func (xfconf *Xfconf) parseProperty(prop Property, channelName, propertyPath str
 		propertyValue = prop.Value
 	}
 
-	xfconf.xfconfItems[curPropertyPath] = XfconfItem{
+	xfconf.xfconfItems[channelName+curPropertyPath] = XfconfItem{
 		Channel:       channelName,
 		PropertyPath:  curPropertyPath,
 		PropertyType:  prop.Type,
@@ -160,54 +225,3 @@ func (xfconf *Xfconf) parseProperty(prop Property, channelName, propertyPath str
 func quoteCommand(command string) string {
 	return "'" + strings.ReplaceAll(command, "'", "'\\''") + "'"
 }
-
-func diffStrings(before, after string) []string {
-	beforeLines := strings.Split(before, "\n")
-	afterLines := strings.Split(after, "\n")
-
-	var diff []string
-	for _, line := range afterLines {
-		if !contains(beforeLines, line) {
-			diff = append(diff, line)
-		}
-	}
-
-	return diff
-}
-
-// contains checks if a string is in a slice of strings.
-func contains(slice []string, str string) bool {
-	for _, s := range slice {
-		if s == str {
-			return true
-		}
-	}
-	return false
-}
-
-func recordProfile() {
-	fmt.Println("Recording changes to xfconf...")
-	xfconf, err := NewXfconf()
-	if err != nil {
-		fmt.Println("Error initializing Xfconf:", err)
-		return
-	}
-
-	blue := color.New(color.FgHiBlue).SprintFunc()
-
-	for {
-		changes, err := xfconf.Diff()
-		if err != nil {
-			fmt.Println("Error getting diff:", err)
-			return
-		}
-
-		if len(changes) > 0 {
-			for _, change := range changes {
-				fmt.Printf("%s %s\n", blue("•"), change)
-			}
-		}
-
-		time.Sleep(250 * time.Millisecond)
-	}
-}
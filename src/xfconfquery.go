@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// XfconfQuery changes properties of the user's session by running xfconf-query
+type XfconfQuery struct {
+	DefaultsSource
+
+	// The user's perchannel XML files, only used to find the types of properties
+	// since xfconf-query does not print them
+	types *Xfconf
+}
+
+func (x *XfconfQuery) Get(channel, property string) (Value, bool, error) {
+	cmd := exec.Command("xfconf-query", "--channel", channel, "--property", property)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		// If there was an error (property not found)
+		return Value{}, false, nil
+	}
+
+	value := parseQueryOutput(strings.TrimRight(stdout.String(), "\n"))
+
+	if x.types == nil {
+		types, err := NewXfconf()
+		if err != nil {
+			return Value{}, false, fmt.Errorf("failed to read current settings: %v", err)
+		}
+		x.types = types
+	}
+	if typed, ok := x.types.Value(channel, property); ok {
+		value = value.withTypesFrom(typed)
+	}
+
+	return value, true, nil
+}
+
+func (x *XfconfQuery) List(channel string) (map[string]Value, error) {
+	output, err := exec.Command("xfconf-query", "--channel", channel, "--list").Output()
+	if err != nil {
+		// The channel does not exist
+		return map[string]Value{}, nil
+	}
+
+	values := make(map[string]Value)
+	for _, property := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if property == "" {
+			continue
+		}
+
+		value, ok, err := x.Get(channel, property)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			values[property] = value
+		}
+	}
+
+	return values, nil
+}
+
+func (x *XfconfQuery) Set(channel, property string, value Value) error {
+	valueArgs, err := value.queryArgs()
+	if err != nil {
+		return fmt.Errorf("cannot set property %s%s: %v", channel, property, err)
+	}
+	args := append([]string{"-c", channel, "--property", property, "--create"}, valueArgs...)
+
+	return runXfconfQuery(args...)
+}
+
+func (x *XfconfQuery) Reset(channel, property string, recursive bool) error {
+	args := []string{"-c", channel, "--reset", "--property", property}
+	if recursive {
+		args = append(args, "--recursive")
+	}
+
+	return runXfconfQuery(args...)
+}
+
+func (x *XfconfQuery) Close() error {
+	return nil
+}
+
+func runXfconfQuery(args ...string) error {
+	cmd := exec.Command("xfconf-query", args...)
+
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to run command: %v\nOutput: %s", err, string(output))
+	}
+	return nil
+}
@@ -12,7 +12,7 @@ fi
 export XFCONF_PROFILE_END_TO_END_TEST=1
 export LOG_LEVEL=debug
 
-xfconf-profile apply profile.json
+xfconf-profile apply --backend xfconf-query profile.json
 
 if diff expected-log.txt actual-log.txt; then
   echo "Differences detected"